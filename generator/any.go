@@ -0,0 +1,111 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+const (
+	coreAnyMessage = ".google.protobuf.Any"
+
+	typeURLPrefix = "type.googleapis.com/"
+)
+
+// anyHelperNames are the members every message gets for packing it into an
+// Any message.
+var anyHelperNames = []string{"TYPE_URL", "pack", "unpack"}
+
+func typeURL(typeName string) string {
+	return typeURLPrefix + strings.TrimPrefix(typeName, ".")
+}
+
+func (g *generator) writeAnyHelpers(w *toit.Writer, className string, typeName string) error {
+	if !g.options.Any {
+		return nil
+	}
+	return util.FirstError(
+		w.StaticConst("TYPE_URL", "string", `"`+typeURL(typeName)+`"`),
+		w.NewLine(),
+
+		w.StartFunctionDecl("pack"),
+		w.EndFunctionDecl("_protobuf.Any"),
+		w.ReturnStart(),
+		w.Argument("_protobuf.Any.pack TYPE_URL this"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+
+		w.StartStaticFunctionDecl("unpack"),
+		w.Parameter("any", "_protobuf.Any"),
+		w.EndFunctionDecl(className),
+		w.StartCall("any.check_type_url"),
+		w.Argument("TYPE_URL"),
+		w.EndCall(true),
+		w.ReturnStart(),
+		w.Argument(className+".deserialize (_protobuf.Reader any.value)"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+	)
+}
+
+// writeRegisterTypes writes a function that adds all messages of the file to
+// a type registry, so Any messages can be unpacked without knowing their type.
+func (g *generator) writeRegisterTypes(w *toit.Writer, file *descriptor.FileDescriptorProto, typePath ...string) error {
+	if !g.options.Any {
+		return nil
+	}
+	classNames, err := g.registeredClassNames(file.GetMessageType(), typePath...)
+	if err != nil {
+		return err
+	}
+	if len(classNames) == 0 {
+		return nil
+	}
+
+	if err := util.FirstError(
+		w.StartFunctionDecl("register_types"),
+		w.Parameter("registry", "_protobuf.TypeRegistry"),
+		w.EndFunctionDecl("none"),
+	); err != nil {
+		return err
+	}
+	for _, className := range classNames {
+		if err := util.FirstError(
+			w.StartCall("registry.add"),
+			w.Argument(className+".TYPE_URL:: "+className+".deserialize it"),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+	return w.EndFunction()
+}
+
+func (g *generator) registeredClassNames(msgs []*descriptor.DescriptorProto, typePath ...string) ([]string, error) {
+	var res []string
+	for _, msg := range msgs {
+		if msg.GetOptions().GetMapEntry() {
+			continue
+		}
+		typeName := typeName(msg.GetName(), typePath...)
+		typ, ok := g.lookupType(typeName)
+		if !ok {
+			return nil, fmt.Errorf("failed to find local msg type: %v", typeName)
+		}
+		res = append(res, typ.ToitType(""))
+
+		nested, err := g.registeredClassNames(msg.GetNestedType(), append(typePath, msg.GetName())...)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, nested...)
+	}
+	return res, nil
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+)
+
+// Field numbers used in SourceCodeInfo paths.
+const (
+	fileMessageTypePath = 4
+	fileEnumTypePath    = 5
+	fileServicePath     = 6
+	fileExtensionPath   = 7
+
+	messageFieldPath      = 2
+	messageNestedTypePath = 3
+	messageEnumTypePath   = 4
+	messageExtensionPath  = 6
+	messageOneofDeclPath  = 8
+
+	enumValuePath = 2
+
+	serviceMethodPath = 2
+)
+
+// resolveComments maps the descriptors of the file to the comments attached
+// to them in the .proto file. Detached comments are ignored, as they are
+// separated from the element by an empty line.
+func resolveComments(file *descriptor.FileDescriptorProto) map[interface{}]string {
+	locations := map[string]*descriptor.SourceCodeInfo_Location{}
+	for _, location := range file.GetSourceCodeInfo().GetLocation() {
+		locations[pathKey(location.GetPath())] = location
+	}
+
+	res := map[interface{}]string{}
+	add := func(d interface{}, path []int32) {
+		if location, ok := locations[pathKey(path)]; ok {
+			if comment := commentText(location); comment != "" {
+				res[d] = comment
+			}
+		}
+	}
+
+	var addEnum func(enum *descriptor.EnumDescriptorProto, path []int32)
+	addEnum = func(enum *descriptor.EnumDescriptorProto, path []int32) {
+		add(enum, path)
+		for i, value := range enum.GetValue() {
+			add(value, subPath(path, enumValuePath, i))
+		}
+	}
+
+	var addMessage func(msg *descriptor.DescriptorProto, path []int32)
+	addMessage = func(msg *descriptor.DescriptorProto, path []int32) {
+		add(msg, path)
+		for i, field := range msg.GetField() {
+			add(field, subPath(path, messageFieldPath, i))
+		}
+		for i, nested := range msg.GetNestedType() {
+			addMessage(nested, subPath(path, messageNestedTypePath, i))
+		}
+		for i, enum := range msg.GetEnumType() {
+			addEnum(enum, subPath(path, messageEnumTypePath, i))
+		}
+		for i, extension := range msg.GetExtension() {
+			add(extension, subPath(path, messageExtensionPath, i))
+		}
+		for i, oneof := range msg.GetOneofDecl() {
+			add(oneof, subPath(path, messageOneofDeclPath, i))
+		}
+	}
+
+	for i, msg := range file.GetMessageType() {
+		addMessage(msg, subPath(nil, fileMessageTypePath, i))
+	}
+	for i, enum := range file.GetEnumType() {
+		addEnum(enum, subPath(nil, fileEnumTypePath, i))
+	}
+	for i, service := range file.GetService() {
+		path := subPath(nil, fileServicePath, i)
+		add(service, path)
+		for j, method := range service.GetMethod() {
+			add(method, subPath(path, serviceMethodPath, j))
+		}
+	}
+	for i, extension := range file.GetExtension() {
+		add(extension, subPath(nil, fileExtensionPath, i))
+	}
+	return res
+}
+
+func subPath(path []int32, field int32, index int) []int32 {
+	res := make([]int32, 0, len(path)+2)
+	return append(append(res, path...), field, int32(index))
+}
+
+func pathKey(path []int32) string {
+	parts := make([]string, len(path))
+	for i, p := range path {
+		parts[i] = strconv.Itoa(int(p))
+	}
+	return strings.Join(parts, ".")
+}
+
+// commentText combines the leading and trailing comments of a location.
+func commentText(location *descriptor.SourceCodeInfo_Location) string {
+	var paragraphs []string
+	for _, comment := range []string{location.GetLeadingComments(), location.GetTrailingComments()} {
+		if text := normalizeComment(comment); text != "" {
+			paragraphs = append(paragraphs, text)
+		}
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// normalizeComment removes the space protoc keeps after the comment markers
+// and any surrounding empty lines.
+func normalizeComment(comment string) string {
+	lines := strings.Split(comment, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(strings.TrimPrefix(line, " "), " \t\r")
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
+
+// writeComment writes the comment of the given descriptor as Toitdoc, if it
+// has one.
+func (g *generator) writeComment(w *toit.Writer, d interface{}) error {
+	comment, ok := g.comments[d]
+	if !ok {
+		return nil
+	}
+	return w.Toitdoc(comment)
+}
@@ -0,0 +1,217 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import "fmt"
+
+const coreValueMessage = ".google.protobuf.Value"
+
+// coreObjectType describes how a well-known message type is mapped to a Toit
+// type when the core_objects option is enabled.
+type coreObjectType struct {
+	// Type is the Toit type the message is mapped to.
+	Type string
+	// Nullable is set for types where null means the field is unset.
+	Nullable bool
+	// Mutable is set for container types that can be modified through the
+	// getter of the field.
+	Mutable      bool
+	DefaultValue string
+	// Arguments are passed to the helpers before the value.
+	Arguments   []string
+	Deserialize string
+	Serialize   string
+	Size        string
+	// ToJSON and FromJSON convert values to and from the proto3 JSON mapping.
+	ToJSON   string
+	FromJSON string
+	// WriteText and ReadText are the methods of the text printer and parser
+	// that write and read the value.
+	WriteText string
+	ReadText  string
+	// Equals and HashCode are the helpers used for structural equality. When
+	// they are empty, the == operator and hash_code method of the type are
+	// used.
+	Equals   string
+	HashCode string
+	// Copy returns a deep copy of a mutable value, and Merge merges the value
+	// given as second argument into the first one. When Merge is empty, a set
+	// value replaces the existing one.
+	Copy  string
+	Merge string
+	// IsDefault is a format for the condition that holds when the value given
+	// as argument is the default value.
+	IsDefault string
+	// Enabled returns whether the mapping is used with the given options. When
+	// it is nil, the mapping only depends on the core_objects option.
+	Enabled func(options generatorOptions) bool
+}
+
+func wrapperType(typ string, protobufType string) *coreObjectType {
+	return &coreObjectType{
+		Type:         typ,
+		Nullable:     true,
+		DefaultValue: "null",
+		Arguments:    []string{"_protobuf." + protobufType},
+		Deserialize:  "_protobuf.deserialize_wrapper",
+		Serialize:    "_protobuf.serialize_wrapper",
+		Size:         "_protobuf.size_wrapper",
+		ToJSON:       "_protobuf.primitive_to_json",
+		FromJSON:     "_protobuf.primitive_from_json",
+		WriteText:    "write_wrapper",
+		ReadText:     "read_wrapper",
+		HashCode:     "_protobuf.nullable_hash_code",
+		IsDefault:    "%s == null",
+		Enabled:      func(options generatorOptions) bool { return options.Wrappers },
+	}
+}
+
+var coreObjectTypes = map[string]*coreObjectType{
+	coreDurationMessage: {
+		Type:         "_core.Duration",
+		DefaultValue: "_core.Duration.ZERO",
+		Deserialize:  "_protobuf.deserialize_duration",
+		Serialize:    "_protobuf.serialize_duration",
+		Size:         "_protobuf.size_duration",
+		ToJSON:       "_protobuf.duration_to_json",
+		FromJSON:     "_protobuf.duration_from_json",
+		WriteText:    "write_duration",
+		ReadText:     "read_duration",
+		IsDefault:    "%s.is_zero",
+	},
+	coreTimestampMessage: {
+		Type:         "_core.Time",
+		DefaultValue: "_protobuf.TIME_ZERO_EPOCH",
+		Deserialize:  "_protobuf.deserialize_timestamp",
+		Serialize:    "_protobuf.serialize_timestamp",
+		Size:         "_protobuf.size_timestamp",
+		ToJSON:       "_protobuf.timestamp_to_json",
+		FromJSON:     "_protobuf.timestamp_from_json",
+		WriteText:    "write_timestamp",
+		ReadText:     "read_timestamp",
+		IsDefault:    "(_protobuf.time_is_zero_epoch %s)",
+	},
+	".google.protobuf.Struct": {
+		Type:         "Map",
+		Mutable:      true,
+		DefaultValue: "{:}",
+		Deserialize:  "_protobuf.deserialize_struct",
+		Serialize:    "_protobuf.serialize_struct",
+		Size:         "_protobuf.size_struct",
+		ToJSON:       "_protobuf.struct_to_json",
+		FromJSON:     "_protobuf.struct_from_json",
+		WriteText:    "write_struct",
+		ReadText:     "read_struct",
+		Equals:       "_protobuf.map_equals",
+		HashCode:     "_protobuf.map_hash_code",
+		Copy:         "_protobuf.copy_struct",
+		Merge:        "_protobuf.merge_struct",
+		IsDefault:    "%s.is_empty",
+		Enabled:      func(options generatorOptions) bool { return options.Struct },
+	},
+	".google.protobuf.ListValue": {
+		Type:         "List",
+		Mutable:      true,
+		DefaultValue: "[]",
+		Deserialize:  "_protobuf.deserialize_list_value",
+		Serialize:    "_protobuf.serialize_list_value",
+		Size:         "_protobuf.size_list_value",
+		ToJSON:       "_protobuf.list_value_to_json",
+		FromJSON:     "_protobuf.list_value_from_json",
+		WriteText:    "write_list_value",
+		ReadText:     "read_list_value",
+		Equals:       "_protobuf.list_equals",
+		HashCode:     "_protobuf.list_hash_code",
+		Copy:         "_protobuf.copy_list_value",
+		Merge:        "_protobuf.merge_list_value",
+		IsDefault:    "%s.is_empty",
+		Enabled:      func(options generatorOptions) bool { return options.Struct },
+	},
+	coreValueMessage: {
+		Type:         "any",
+		Nullable:     true,
+		DefaultValue: "null",
+		Deserialize:  "_protobuf.deserialize_value",
+		Serialize:    "_protobuf.serialize_value",
+		Size:         "_protobuf.size_value",
+		ToJSON:       "_protobuf.value_to_json",
+		FromJSON:     "_protobuf.value_from_json",
+		WriteText:    "write_value",
+		ReadText:     "read_value",
+		Equals:       "_protobuf.value_equals",
+		HashCode:     "_protobuf.value_hash_code",
+		Copy:         "_protobuf.copy_value",
+		IsDefault:    "%s == null",
+		Enabled:      func(options generatorOptions) bool { return options.Struct },
+	},
+	coreAnyMessage: {
+		Type:         "_protobuf.Any",
+		Mutable:      true,
+		DefaultValue: "_protobuf.Any",
+		Deserialize:  "_protobuf.deserialize_any",
+		Serialize:    "_protobuf.serialize_any",
+		Size:         "_protobuf.size_any",
+		ToJSON:       "_protobuf.any_to_json",
+		FromJSON:     "_protobuf.any_from_json",
+		WriteText:    "write_any",
+		ReadText:     "read_any",
+		Copy:         "_protobuf.copy_any",
+		IsDefault:    "%s.is_empty",
+		Enabled:      func(options generatorOptions) bool { return options.Any },
+	},
+	coreFieldMaskMessage: {
+		Type:         "List",
+		Mutable:      true,
+		DefaultValue: "[]",
+		Deserialize:  "_protobuf.deserialize_field_mask",
+		Serialize:    "_protobuf.serialize_field_mask",
+		Size:         "_protobuf.size_field_mask",
+		ToJSON:       "_protobuf.field_mask_to_json",
+		FromJSON:     "_protobuf.field_mask_from_json",
+		WriteText:    "write_field_mask",
+		ReadText:     "read_field_mask",
+		Equals:       "_protobuf.list_equals",
+		HashCode:     "_protobuf.list_hash_code",
+		Copy:         "_protobuf.copy_field_mask",
+		Merge:        "_protobuf.merge_field_mask",
+		IsDefault:    "%s.is_empty",
+		Enabled:      func(options generatorOptions) bool { return options.FieldMask },
+	},
+	".google.protobuf.DoubleValue": wrapperType("float", "PROTOBUF_TYPE_DOUBLE"),
+	".google.protobuf.FloatValue":  wrapperType("float", "PROTOBUF_TYPE_FLOAT"),
+	".google.protobuf.Int64Value":  wrapperType("int", "PROTOBUF_TYPE_INT64"),
+	".google.protobuf.UInt64Value": wrapperType("int", "PROTOBUF_TYPE_UINT64"),
+	".google.protobuf.Int32Value":  wrapperType("int", "PROTOBUF_TYPE_INT32"),
+	".google.protobuf.UInt32Value": wrapperType("int", "PROTOBUF_TYPE_UINT32"),
+	".google.protobuf.BoolValue":   wrapperType("bool", "PROTOBUF_TYPE_BOOL"),
+	".google.protobuf.StringValue": wrapperType("string", "PROTOBUF_TYPE_STRING"),
+	".google.protobuf.BytesValue":  wrapperType("ByteArray", "PROTOBUF_TYPE_BYTES"),
+}
+
+// coreObjectType returns the mapping of a message type, if the message type
+// is mapped to a Toit type.
+func (g *generator) coreObjectType(t *referType) (*coreObjectType, bool) {
+	if t == nil {
+		return nil, false
+	}
+	return g.coreMessageType(t.Name())
+}
+
+// coreMessageType returns the mapping of the message type with the given
+// name, if it is enabled by the options.
+func (g *generator) coreMessageType(name string) (*coreObjectType, bool) {
+	if !g.options.CoreObjects {
+		return nil, false
+	}
+	res, ok := coreObjectTypes[name]
+	if !ok || (res.Enabled != nil && !res.Enabled(g.options)) {
+		return nil, false
+	}
+	return res, true
+}
+
+func (c *coreObjectType) isDefaultCondition(fieldName string) string {
+	return fmt.Sprintf(c.IsDefault, fieldName)
+}
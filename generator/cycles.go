@@ -0,0 +1,55 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// eagerMessageFields returns the types of the message fields that are
+// allocated together with a message of the given type.
+func (g *generator) eagerMessageFields(t *referType) []*referType {
+	var res []*referType
+	for _, field := range t.msg.GetField() {
+		if !isMessageType(field.GetType()) ||
+			field.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REPEATED ||
+			(field.OneofIndex != nil && !isProto3Optional(field)) ||
+			g.isCoreMessage(field.GetTypeName()) {
+			continue
+		}
+		if fieldType, ok := g.lookupType(field.GetTypeName()); ok && fieldType.msg != nil {
+			res = append(res, fieldType)
+		}
+	}
+	return res
+}
+
+// reachesType returns true if allocating a message of type from would
+// allocate a message of type to, if all message fields were allocated eagerly.
+func (g *generator) reachesType(from *referType, to *referType, visited map[*referType]bool) bool {
+	if from == to {
+		return true
+	}
+	if visited[from] {
+		return false
+	}
+	visited[from] = true
+	for _, t := range g.eagerMessageFields(from) {
+		if g.reachesType(t, to, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRecursiveField returns true if the message field of msg is part of a
+// cycle of message fields, which means it can't be allocated together with
+// its message.
+func (g *generator) isRecursiveField(msg *referType, fieldType *fieldType) bool {
+	if fieldType.class != fieldTypeClassObject || g.isCoreObject(fieldType) || fieldType.t.msg == nil {
+		return false
+	}
+	return g.reachesType(fieldType.t, msg, map[*referType]bool{})
+}
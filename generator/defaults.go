@@ -0,0 +1,231 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+// enumDefaultValue returns the declared default of an enum field, or the
+// first value of the enum if none is declared.
+func enumDefaultValue(field *descriptor.FieldDescriptorProto, t *referType) (string, error) {
+	if t == nil || t.enum == nil {
+		return "", fmt.Errorf("fieldtype was not an enum: %v for field: %s", field.GetTypeName(), field.GetName())
+	}
+	values := t.enum.GetValue()
+	if field.DefaultValue == nil {
+		if len(values) == 0 {
+			return "0", nil
+		}
+		return strconv.Itoa(int(values[0].GetNumber())), nil
+	}
+	for _, value := range values {
+		if value.GetName() == field.GetDefaultValue() {
+			return strconv.Itoa(int(value.GetNumber())), nil
+		}
+	}
+	return "", fmt.Errorf("unknown default value: %s for enum field: %s", field.GetDefaultValue(), field.GetName())
+}
+
+// defaultValueLiteral converts the textual default value protoc puts into
+// FieldDescriptorProto.default_value into a Toit literal.
+func defaultValueLiteral(ft descriptor.FieldDescriptorProto_Type, value string) (string, error) {
+	switch ft {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE, descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return floatLiteral(value)
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_INT32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64, descriptor.FieldDescriptorProto_TYPE_SFIXED32,
+		descriptor.FieldDescriptorProto_TYPE_SINT64, descriptor.FieldDescriptorProto_TYPE_SINT32:
+		i, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse default value: %s reason: %w", value, err)
+		}
+		return strconv.FormatInt(i, 10), nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_UINT32,
+		descriptor.FieldDescriptorProto_TYPE_FIXED64, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		u, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse default value: %s reason: %w", value, err)
+		}
+		// Toit integers are signed 64 bit. Values above int.MAX are mapped to
+		// the int with the same two's-complement bits, which is also how the
+		// runtime represents such values when it reads them from the wire.
+		return strconv.FormatInt(int64(u), 10), nil
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse default value: %s reason: %w", value, err)
+		}
+		return strconv.FormatBool(b), nil
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		return stringLiteral(value), nil
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		b, err := unescapeBytes(value)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse default value: %s reason: %w", value, err)
+		}
+		return byteArrayLiteral(b), nil
+	default:
+		return "", fmt.Errorf("unsupported default value: %s for type: %v", value, ft)
+	}
+}
+
+// defaultComparison returns the condition that holds when value equals the
+// default value, or differs from it if equal is false. NaN never compares
+// equal to itself, so NaN defaults are checked with is_nan.
+func defaultComparison(value string, defaultValue string, equal bool) string {
+	if defaultValue == "float.NAN" {
+		if equal {
+			return value + ".is_nan"
+		}
+		return "not " + value + ".is_nan"
+	}
+	if equal {
+		return value + " == " + defaultValue
+	}
+	return value + " != " + defaultValue
+}
+
+func floatLiteral(value string) (string, error) {
+	switch value {
+	case "inf":
+		return "float.INFINITY", nil
+	case "-inf":
+		return "-float.INFINITY", nil
+	case "nan":
+		return "float.NAN", nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse default value: %s reason: %w", value, err)
+	}
+	switch {
+	case math.IsInf(f, 1):
+		return "float.INFINITY", nil
+	case math.IsInf(f, -1):
+		return "-float.INFINITY", nil
+	case math.IsNaN(f):
+		return "float.NAN", nil
+	}
+
+	res := strconv.FormatFloat(f, 'g', -1, 64)
+	mantissa, exponent := res, ""
+	if i := strings.IndexByte(res, 'e'); i >= 0 {
+		mantissa, exponent = res[:i], res[i:]
+	}
+	if !strings.Contains(mantissa, ".") {
+		mantissa += ".0"
+	}
+	return mantissa + exponent, nil
+}
+
+func stringLiteral(value string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"', '\\', '$':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&sb, `\x%02x`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func byteArrayLiteral(b []byte) string {
+	if len(b) == 0 {
+		return "ByteArray 0"
+	}
+	elements := make([]string, len(b))
+	for i, c := range b {
+		elements[i] = fmt.Sprintf("0x%02x", c)
+	}
+	return "#[" + strings.Join(elements, ", ") + "]"
+}
+
+// unescapeBytes reverses the C-style escaping protoc applies to the default
+// value of bytes fields.
+func unescapeBytes(value string) ([]byte, error) {
+	var res []byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			res = append(res, c)
+			continue
+		}
+		i++
+		if i == len(value) {
+			return nil, fmt.Errorf("trailing backslash")
+		}
+		c = value[i]
+		switch c {
+		case 'a':
+			res = append(res, '\a')
+		case 'b':
+			res = append(res, '\b')
+		case 'f':
+			res = append(res, '\f')
+		case 'n':
+			res = append(res, '\n')
+		case 'r':
+			res = append(res, '\r')
+		case 't':
+			res = append(res, '\t')
+		case 'v':
+			res = append(res, '\v')
+		case '\\', '\'', '"', '?':
+			res = append(res, c)
+		case 'x', 'X':
+			j := i + 1
+			for j < len(value) && j < i+3 && isHexDigit(value[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("invalid hex escape at offset %d", i)
+			}
+			n, _ := strconv.ParseUint(value[i+1:j], 16, 8)
+			res = append(res, byte(n))
+			i = j - 1
+		default:
+			if c < '0' || c > '7' {
+				return nil, fmt.Errorf("invalid escape sequence '\\%c'", c)
+			}
+			j := i
+			for j < len(value) && j < i+3 && value[j] >= '0' && value[j] <= '7' {
+				j++
+			}
+			n, err := strconv.ParseUint(value[i:j], 8, 16)
+			if err != nil || n > 0xff {
+				return nil, fmt.Errorf("invalid octal escape '\\%s'", value[i:j])
+			}
+			res = append(res, byte(n))
+			i = j - 1
+		}
+	}
+	return res, nil
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+func TestDefaultValueLiteral(t *testing.T) {
+	tests := []struct {
+		typ   descriptor.FieldDescriptorProto_Type
+		input string
+		want  string
+	}{
+		{descriptor.FieldDescriptorProto_TYPE_INT32, "3", "3"},
+		{descriptor.FieldDescriptorProto_TYPE_SINT64, "-42", "-42"},
+		{descriptor.FieldDescriptorProto_TYPE_UINT32, "0x10", "16"},
+		{descriptor.FieldDescriptorProto_TYPE_UINT64, "9223372036854775807", "9223372036854775807"},
+		{descriptor.FieldDescriptorProto_TYPE_UINT64, "9223372036854775808", "-9223372036854775808"},
+		{descriptor.FieldDescriptorProto_TYPE_UINT64, "18446744073709551615", "-1"},
+		{descriptor.FieldDescriptorProto_TYPE_FIXED64, "18446744073709551614", "-2"},
+		{descriptor.FieldDescriptorProto_TYPE_DOUBLE, "1", "1.0"},
+		{descriptor.FieldDescriptorProto_TYPE_DOUBLE, "-0.25", "-0.25"},
+		{descriptor.FieldDescriptorProto_TYPE_DOUBLE, "1e+20", "1.0e+20"},
+		{descriptor.FieldDescriptorProto_TYPE_FLOAT, "1.5e-07", "1.5e-07"},
+		{descriptor.FieldDescriptorProto_TYPE_DOUBLE, "inf", "float.INFINITY"},
+		{descriptor.FieldDescriptorProto_TYPE_FLOAT, "-inf", "-float.INFINITY"},
+		{descriptor.FieldDescriptorProto_TYPE_DOUBLE, "nan", "float.NAN"},
+		{descriptor.FieldDescriptorProto_TYPE_BOOL, "true", "true"},
+		{descriptor.FieldDescriptorProto_TYPE_STRING, "", `""`},
+		{descriptor.FieldDescriptorProto_TYPE_STRING, `say "hi" for $5`, `"say \"hi\" for \$5"`},
+		{descriptor.FieldDescriptorProto_TYPE_STRING, "a\\b\nc", `"a\\b\nc"`},
+		{descriptor.FieldDescriptorProto_TYPE_BYTES, "", "ByteArray 0"},
+		{descriptor.FieldDescriptorProto_TYPE_BYTES, `\001\002ab`, "#[0x01, 0x02, 0x61, 0x62]"},
+		{descriptor.FieldDescriptorProto_TYPE_BYTES, `\377\x7f\"\'\\\n`, "#[0xff, 0x7f, 0x22, 0x27, 0x5c, 0x0a]"},
+	}
+	for _, test := range tests {
+		have, err := defaultValueLiteral(test.typ, test.input)
+		if err != nil {
+			t.Errorf("input=%q: unexpected error: %v", test.input, err)
+			continue
+		}
+		if have != test.want {
+			t.Errorf("input=%q:\nhave: %q\nwant: %q", test.input, have, test.want)
+		}
+	}
+}
+
+func TestDefaultComparison(t *testing.T) {
+	tests := []struct {
+		defaultValue string
+		equal        bool
+		want         string
+	}{
+		{"3", true, "x == 3"},
+		{"3", false, "x != 3"},
+		{"float.INFINITY", false, "x != float.INFINITY"},
+		{"float.NAN", true, "x.is_nan"},
+		{"float.NAN", false, "not x.is_nan"},
+	}
+	for _, test := range tests {
+		if have := defaultComparison("x", test.defaultValue, test.equal); have != test.want {
+			t.Errorf("default=%q equal=%v:\nhave: %q\nwant: %q", test.defaultValue, test.equal, have, test.want)
+		}
+	}
+}
+
+func TestDefaultValueLiteralInvalid(t *testing.T) {
+	tests := []struct {
+		typ   descriptor.FieldDescriptorProto_Type
+		input string
+	}{
+		{descriptor.FieldDescriptorProto_TYPE_INT32, "three"},
+		{descriptor.FieldDescriptorProto_TYPE_UINT64, "-1"},
+		{descriptor.FieldDescriptorProto_TYPE_BOOL, "yes"},
+		{descriptor.FieldDescriptorProto_TYPE_BYTES, `\400`},
+		{descriptor.FieldDescriptorProto_TYPE_BYTES, `abc\`},
+	}
+	for _, test := range tests {
+		if have, err := defaultValueLiteral(test.typ, test.input); err == nil {
+			t.Errorf("input=%q: expected error, have: %q", test.input, have)
+		}
+	}
+}
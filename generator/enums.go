@@ -0,0 +1,86 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"strings"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+// isClosedEnum returns true if the type is an enum that only accepts the
+// values it defines, which is the case for enums declared in proto2 files.
+// Proto3 enums are open and keep unknown values.
+func isClosedEnum(t *referType) bool {
+	return t != nil && t.enum != nil && isProto2(t.file)
+}
+
+// writeClosedEnumArgument passes the known values of a closed enum to the
+// reader, for fields that hold values of one. The reader moves fields with
+// other values to the unknown fields. For maps, the whole entry is moved if
+// its value is unknown. Without the closed_enums option, closed enums are
+// read like open ones.
+func (g *generator) writeClosedEnumArgument(w *toit.Writer, fieldType *fieldType) error {
+	if !g.options.ClosedEnums {
+		return nil
+	}
+	if fieldType.class == fieldTypeClassList || fieldType.class == fieldTypeClassMap {
+		fieldType = fieldType.valueType
+	}
+	if fieldType.field.GetType() != descriptor.FieldDescriptorProto_TYPE_ENUM || !isClosedEnum(fieldType.t) {
+		return nil
+	}
+	known, err := g.enumTable(fieldType.t, "KNOWN_VALUES")
+	if err != nil {
+		return err
+	}
+	return w.NamedArgument("--closed_enum", known)
+}
+
+// writeEnumClass writes a class with static helpers for the values of an
+// enum. The values themselves stay top-level constants, so the class only
+// holds the tables written by writeEnumTables and lookups in them. Keeping
+// the tables in the class means they can't clash with the names of the
+// values. With allow_alias, VALUES lists each number once and name_of returns
+// the first name declared for it, while value_of accepts every alias. The
+// comment of the enum is attached to the class.
+func (g *generator) writeEnumClass(w *toit.Writer, enum *descriptor.EnumDescriptorProto, className string) error {
+	var values []string
+	seen := map[int32]bool{}
+	for _, value := range enum.GetValue() {
+		if seen[value.GetNumber()] {
+			continue
+		}
+		seen[value.GetNumber()] = true
+		values = append(values, toitClassName(value.GetName(), className))
+	}
+	return util.FirstError(
+		w.NewLine(),
+		g.writeComment(w, enum),
+		w.StartClass(className, ""),
+		w.StaticConst("VALUES", "List", "["+strings.Join(values, ", ")+"]"),
+		g.writeEnumTables(w, enum),
+		w.NewLine(),
+
+		w.StartStaticFunctionDecl("name_of"),
+		w.Parameter("value", "int"),
+		w.EndFunctionDecl("string?"),
+		w.ReturnStart(),
+		w.Argument("NAMES.get value"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+
+		w.StartStaticFunctionDecl("value_of"),
+		w.Parameter("name", "string"),
+		w.EndFunctionDecl("int?"),
+		w.ReturnStart(),
+		w.Argument("NUMBERS.get name"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+		w.EndClass(),
+	)
+}
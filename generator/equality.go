@@ -0,0 +1,201 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"strings"
+
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+// equalityHelperNames are the members every message gets for structural
+// equality.
+var equalityHelperNames = []string{"hash_code"}
+
+// notEqualCondition returns the condition that holds when the two values of
+// the given field type differ.
+func (g *generator) notEqualCondition(fieldType *fieldType, a string, b string) string {
+	switch fieldType.class {
+	case fieldTypeClassList:
+		return "not _protobuf.list_equals " + a + " " + b
+	case fieldTypeClassMap:
+		return "not _protobuf.map_equals " + a + " " + b
+	case fieldTypeClassObject:
+		if coreObject, ok := g.coreObjectType(fieldType.t); ok && coreObject.Equals != "" {
+			return "not " + coreObject.Equals + " " + a + " " + b
+		}
+	}
+	return a + " != " + b
+}
+
+// hashCodeExpression returns the hash code of a value of the given field type.
+func (g *generator) hashCodeExpression(fieldType *fieldType, value string) string {
+	switch fieldType.class {
+	case fieldTypeClassList:
+		return "_protobuf.list_hash_code " + value
+	case fieldTypeClassMap:
+		return "_protobuf.map_hash_code " + value
+	case fieldTypeClassObject:
+		if coreObject, ok := g.coreObjectType(fieldType.t); ok && coreObject.HashCode != "" {
+			return coreObject.HashCode + " " + value
+		}
+	}
+	return value + ".hash_code"
+}
+
+// fieldGuard returns the condition under which the value of a field takes
+// part in equality and hashing, or "" if it always does.
+func (g *generator) fieldGuard(fieldType *fieldType, oneofTypes []*oneofType) (string, error) {
+	if fieldType.IsOneof() || g.hasPresence(fieldType) {
+		return g.isSetCondition(fieldType, oneofTypes, "this.")
+	}
+	return "", nil
+}
+
+// writeEqualsOperator writes an == operator that compares the fields and
+// extensions of two messages. Fields with presence and oneofs are only equal
+// if they are set in both messages. Unknown fields are raw bytes whose
+// encoding is not unique, so they are intentionally not compared.
+func (g *generator) writeEqualsOperator(w *toit.Writer, className string, extendee string, fields []*fieldType, oneofTypes []*oneofType) error {
+	if !g.options.Equality {
+		return nil
+	}
+	if err := util.FirstError(
+		w.StartFunctionDecl("operator =="),
+		w.Parameter("other", ""),
+		w.EndFunctionDecl("bool"),
+		g.writeReturnFalseIf(w, "other is not "+className),
+	); err != nil {
+		return err
+	}
+
+	comparedOneofs := map[int32]bool{}
+	for _, fieldType := range fields {
+		fieldName := fieldType.FieldName(oneofTypes)
+		notEqual := g.notEqualCondition(fieldType, "this."+fieldName, "other."+fieldName)
+		if fieldType.IsOneof() {
+			index := fieldType.field.GetOneofIndex()
+			if !comparedOneofs[index] {
+				comparedOneofs[index] = true
+				caseName := oneofTypes[index].CaseName
+				if err := g.writeReturnFalseIf(w, "this."+caseName+" != other."+caseName); err != nil {
+					return err
+				}
+			}
+		} else if g.hasPresence(fieldType) {
+			if err := g.writeReturnFalseIf(w, "this.has_"+fieldName+" != other.has_"+fieldName); err != nil {
+				return err
+			}
+		}
+
+		guard, err := g.fieldGuard(fieldType, oneofTypes)
+		if err != nil {
+			return err
+		}
+		if guard != "" {
+			notEqual = guard + " and " + notEqual
+		}
+		if err := g.writeReturnFalseIf(w, notEqual); err != nil {
+			return err
+		}
+	}
+
+	if extendee != "" {
+		if err := g.writeReturnFalseIf(w, "not _protobuf.extensions_equals this."+extensionsName+" other."+extensionsName); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		w.ReturnStart(),
+		w.Argument("true"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+	)
+}
+
+func (g *generator) writeReturnFalseIf(w *toit.Writer, condition string) error {
+	return util.FirstError(
+		w.StartCall("if"),
+		w.Argument(condition),
+		w.StartBlock(false),
+		w.ReturnStart(),
+		w.Argument("false"),
+		w.ReturnEnd(),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
+
+// writeHashCodeMethod writes a hash_code method that is consistent with the
+// == operator.
+func (g *generator) writeHashCodeMethod(w *toit.Writer, extendee string, fields []*fieldType, oneofTypes []*oneofType) error {
+	if !g.options.Equality {
+		return nil
+	}
+	fieldNames := util.NewStringSet()
+	for _, fieldType := range fields {
+		fieldNames.Add(fieldType.FieldName(oneofTypes))
+	}
+	result := uniqueName("result", fieldNames, "_")
+
+	if err := util.FirstError(
+		w.StartFunctionDecl("hash_code"),
+		w.EndFunctionDecl("int"),
+		w.Variable(result, "", "1"),
+	); err != nil {
+		return err
+	}
+
+	for _, fieldType := range fields {
+		guard, err := g.fieldGuard(fieldType, oneofTypes)
+		if err != nil {
+			return err
+		}
+		hashCode := g.hashCodeExpression(fieldType, "this."+fieldType.FieldName(oneofTypes))
+		if guard == "" {
+			if err := writeHashCombine(w, result, hashCode); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := util.FirstError(
+			w.StartCall("if"),
+			w.Argument(guard),
+			w.StartBlock(false),
+			writeHashCombine(w, result, hashCode),
+			w.EndBlock(false),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+
+	if extendee != "" {
+		if err := writeHashCombine(w, result, "_protobuf.extensions_hash_code this."+extensionsName); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		w.ReturnStart(),
+		w.Argument(result),
+		w.ReturnEnd(),
+		w.EndFunction(),
+	)
+}
+
+// writeHashCombine combines the hash code of a value into the result.
+func writeHashCombine(w *toit.Writer, result string, hashCode string) error {
+	if strings.Contains(hashCode, " ") {
+		hashCode = "(" + hashCode + ")"
+	}
+	return util.FirstError(
+		w.StartAssignment(result),
+		w.Argument("_protobuf.hash_combine "+result+" "+hashCode),
+		w.EndAssignment(),
+	)
+}
@@ -0,0 +1,414 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+// extensionsName is the member holding the extension values of an extendable
+// message, keyed by their extension identifier.
+const extensionsName = "extensions_"
+
+type extensionType struct {
+	Constant  string
+	Extendee  string
+	FieldType *fieldType
+}
+
+// resolveExtensionTypes collects the extensions declared at the top level of
+// the file and inside its messages.
+func (g *generator) resolveExtensionTypes(file *descriptor.FileDescriptorProto, typePath ...string) ([]*extensionType, error) {
+	res, err := g.resolveScopeExtensionTypes(file.GetExtension(), "")
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range file.GetMessageType() {
+		msgRes, err := g.resolveMessageExtensionTypes(msg, typePath...)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, msgRes...)
+	}
+
+	definedNames := util.NewStringSet()
+	for _, ext := range res {
+		if definedNames.Contains(ext.Constant) {
+			return nil, fmt.Errorf("name clash for extension: %v", ext.Constant)
+		}
+		definedNames.Add(ext.Constant)
+	}
+	return res, nil
+}
+
+func (g *generator) resolveMessageExtensionTypes(msg *descriptor.DescriptorProto, typePath ...string) ([]*extensionType, error) {
+	typeName := typeName(msg.GetName(), typePath...)
+	typ, ok := g.lookupType(typeName)
+	if !ok {
+		return nil, fmt.Errorf("failed to find local msg type: %v", typeName)
+	}
+	res, err := g.resolveScopeExtensionTypes(msg.GetExtension(), typ.ToitType(""))
+	if err != nil {
+		return nil, err
+	}
+
+	recTypePath := append(typePath, msg.GetName())
+	for _, subMsg := range msg.GetNestedType() {
+		subRes, err := g.resolveMessageExtensionTypes(subMsg, recTypePath...)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, subRes...)
+	}
+	return res, nil
+}
+
+func (g *generator) resolveScopeExtensionTypes(extensions []*descriptor.FieldDescriptorProto, scope string) ([]*extensionType, error) {
+	var res []*extensionType
+	for _, field := range extensions {
+		fieldType, err := g.resolveFieldType(field, false)
+		if err != nil {
+			return nil, err
+		}
+
+		constant := strings.ToUpper(field.GetName())
+		if scope != "" {
+			constant = toitClassName(constant, scope)
+		}
+		res = append(res, &extensionType{
+			Constant:  constant,
+			Extendee:  strings.TrimPrefix(field.GetExtendee(), "."),
+			FieldType: fieldType,
+		})
+	}
+	return res, nil
+}
+
+func (g *generator) writeExtensions(w *toit.Writer, file *descriptor.FileDescriptorProto, typePath ...string) error {
+	if !g.options.Extensions {
+		return nil
+	}
+	extensions, err := g.resolveExtensionTypes(file, typePath...)
+	if err != nil {
+		return err
+	}
+	if len(extensions) == 0 {
+		return nil
+	}
+
+	w.SingleLineComment("EXTENSIONS START: " + file.GetName())
+	for _, ext := range extensions {
+		if err := g.writeExtension(w, ext); err != nil {
+			return err
+		}
+	}
+	w.NewLine()
+
+	if err := util.FirstError(
+		w.StartFunctionDecl("register_extensions"),
+		w.Parameter("registry", "_protobuf.ExtensionRegistry"),
+		w.EndFunctionDecl("none"),
+	); err != nil {
+		return err
+	}
+	for _, ext := range extensions {
+		if err := util.FirstError(
+			w.StartCall("registry.add"),
+			w.Argument(ext.Constant),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+	return util.FirstError(
+		w.EndFunction(),
+		w.SingleLineComment("EXTENSIONS END: "+file.GetName()),
+		w.NewLine(),
+	)
+}
+
+func (g *generator) writeExtension(w *toit.Writer, ext *extensionType) error {
+	field := ext.FieldType.field
+	protoType, err := protobufTypeConst(field.GetType())
+	if err != nil {
+		return err
+	}
+
+	if err := util.FirstError(
+		g.writeComment(w, field),
+		w.Literal(ext.Constant),
+		w.Type("_protobuf.Extension"),
+		w.Literal(" ::= "),
+		w.StartCall("_protobuf.Extension"),
+		w.Argument(`"`+ext.Extendee+`"`),
+		w.Argument(strconv.Itoa(int(field.GetNumber()))),
+		w.Argument("_protobuf."+protoType),
+	); err != nil {
+		return err
+	}
+
+	if ext.FieldType.class == fieldTypeClassList {
+		if err := util.FirstError(
+			w.NamedArgument("--repeated", ""),
+			g.writePackedArgument(w, field),
+		); err != nil {
+			return err
+		}
+	}
+	if err := g.writeClosedEnumArgument(w, ext.FieldType); err != nil {
+		return err
+	}
+
+	switch field.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE, descriptor.FieldDescriptorProto_TYPE_GROUP:
+		messageType, err := g.methodMessageType(field.GetTypeName())
+		if err != nil {
+			return err
+		}
+		if err := w.NamedArgument("--deserialize", "(:: "+messageType+".deserialize it)"); err != nil {
+			return err
+		}
+	default:
+		if ext.FieldType.class == fieldTypeClassPrimitive {
+			defaultValue, err := ext.FieldType.DefaultValue()
+			if err != nil {
+				return err
+			}
+			if err := w.NamedArgument("--default", defaultValue); err != nil {
+				return err
+			}
+		}
+	}
+	return w.EndCall(true)
+}
+
+// writeExtensionAccessors writes the methods of an extendable message. The
+// values are stored in a map that is only allocated when the first extension
+// is set.
+func (g *generator) writeExtensionAccessors(w *toit.Writer, extendee string) error {
+	return util.FirstError(
+		w.StartFunctionDecl("get_extension"),
+		w.Parameter("extension", "_protobuf.Extension"),
+		w.EndFunctionDecl("any"),
+		g.writeCheckExtendee(w, extendee),
+		w.StartCall("if"),
+		w.Argument("not has_extension extension"),
+		w.StartBlock(false),
+		w.ReturnStart(),
+		w.Argument("extension.default_value"),
+		w.ReturnEnd(),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.ReturnStart(),
+		w.Argument(extensionsName+"[extension]"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+
+		w.StartFunctionDecl("set_extension"),
+		w.Parameter("extension", "_protobuf.Extension"),
+		w.Parameter("value", "any"),
+		w.EndFunctionDecl("none"),
+		g.writeCheckExtendee(w, extendee),
+		w.StartCall("if"),
+		w.Argument("not "+extensionsName),
+		w.StartBlock(false),
+		w.StartAssignment(extensionsName),
+		w.Argument("{:}"),
+		w.EndAssignment(),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.StartAssignment(extensionsName+"[extension]"),
+		w.Argument("value"),
+		w.EndAssignment(),
+		w.EndFunction(),
+
+		w.StartFunctionDecl("has_extension"),
+		w.Parameter("extension", "_protobuf.Extension"),
+		w.EndFunctionDecl("bool"),
+		w.ReturnStart(),
+		w.Argument(extensionsName+" != null and "+extensionsName+".contains extension"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+
+		w.StartFunctionDecl("clear_extension"),
+		w.Parameter("extension", "_protobuf.Extension"),
+		w.EndFunctionDecl("none"),
+		w.StartCall("if"),
+		w.Argument(extensionsName),
+		w.StartBlock(false),
+		w.StartCall(extensionsName+".remove"),
+		w.Argument("extension"),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.EndFunction(),
+	)
+}
+
+func (g *generator) writeCheckExtendee(w *toit.Writer, extendee string) error {
+	return util.FirstError(
+		w.StartCall("extension.check_extendee"),
+		w.Argument(`"`+extendee+`"`),
+		w.EndCall(true),
+	)
+}
+
+// writeReadExtensionCall decodes the fields that belong to an extension known
+// by the registry of the reader.
+func (g *generator) writeReadExtensionCall(w *toit.Writer, objectName string, extendee string) error {
+	setExtension := "set_extension"
+	if objectName != "" {
+		setExtension = objectName + "." + setExtension
+	}
+	return util.FirstError(
+		w.StartCall("r.read_extension"),
+		w.Argument(`"`+extendee+`"`),
+		w.StartBlock(false, "extension/_protobuf.Extension", "value"),
+		w.StartCall(setExtension),
+		w.Argument("extension"),
+		w.Argument("value"),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
+
+// serializeStep is a field, or a group of extension ranges without fields
+// between them, that is serialized.
+type serializeStep struct {
+	field *fieldType
+	// from and to are the numbers of the extensions of a group, where to is
+	// exclusive.
+	from int32
+	to   int32
+}
+
+// serializeOrder returns the fields and extension ranges of a message in the
+// order they are serialized in. Extensions are interleaved with the fields by
+// number, like the deterministic output of other implementations.
+func serializeOrder(fields []*fieldType, extensionRanges []*descriptor.DescriptorProto_ExtensionRange) []serializeStep {
+	ranges := append([]*descriptor.DescriptorProto_ExtensionRange{}, extensionRanges...)
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].GetStart() < ranges[j].GetStart()
+	})
+
+	var res []serializeStep
+	i := 0
+	for _, fieldType := range sortFieldsByNumber(fields) {
+		for ; i < len(ranges) && ranges[i].GetStart() < fieldType.field.GetNumber(); i++ {
+			res = appendExtensionRange(res, ranges[i])
+		}
+		res = append(res, serializeStep{field: fieldType})
+	}
+	for ; i < len(ranges); i++ {
+		res = appendExtensionRange(res, ranges[i])
+	}
+	return res
+}
+
+func appendExtensionRange(steps []serializeStep, r *descriptor.DescriptorProto_ExtensionRange) []serializeStep {
+	if n := len(steps); n > 0 && steps[n-1].field == nil {
+		steps[n-1].to = r.GetEnd()
+		return steps
+	}
+	return append(steps, serializeStep{from: r.GetStart(), to: r.GetEnd()})
+}
+
+// writeSerializeExtensions writes the extensions of a group. With bounded,
+// only the extensions with numbers in the group are written.
+func (g *generator) writeSerializeExtensions(w *toit.Writer, step serializeStep, bounded bool) error {
+	return util.FirstError(
+		w.StartCall("if"),
+		w.Argument(extensionsName),
+		w.StartBlock(false),
+		w.StartCall("w.write_extensions"),
+		w.Argument(extensionsName),
+		func() error {
+			if !bounded {
+				return nil
+			}
+			return util.FirstError(
+				w.NamedArgument("--from", strconv.Itoa(int(step.from))),
+				w.NamedArgument("--to", strconv.Itoa(int(step.to))),
+			)
+		}(),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
+
+func (g *generator) writeNumExtensions(w *toit.Writer) error {
+	return w.ConditionExpression(extensionsName+" == null", "0", extensionsName+".size")
+}
+
+func (g *generator) writeProtobufSizeExtensions(w *toit.Writer) error {
+	return w.ConditionExpression(extensionsName+" == null", "0", "(_protobuf.size_extensions "+extensionsName+")")
+}
+
+// extensionValueCopy returns an expression that copies a single extension
+// value. The type of extension values is only known at runtime, so messages
+// and byte arrays are recognized with type tests.
+func extensionValueCopy(value string) string {
+	return value + " is _protobuf.Message or " + value + " is ByteArray ? " + value + ".copy : " + value
+}
+
+// writeMergeExtensions merges the extensions of other into this message with
+// the same semantics as regular fields: repeated values are appended, message
+// values are merged recursively, and other values replace the existing ones.
+// The values are copied, so the messages don't share mutable values.
+func (g *generator) writeMergeExtensions(w *toit.Writer) error {
+	return util.FirstError(
+		w.StartCall("if"),
+		w.Argument("other."+extensionsName),
+		w.StartBlock(false),
+		w.StartCall("other."+extensionsName+".do"),
+		w.StartBlock(false, "extension", "value"),
+		w.StartCall("if"),
+		w.Argument("value is List"),
+		w.StartBlock(false),
+		w.StartCall("if"),
+		w.Argument("not has_extension extension"),
+		w.StartBlock(false),
+		w.StartCall("set_extension"),
+		w.Argument("extension"),
+		w.Argument("[]"),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.StartCall("(get_extension extension).add_all"),
+		w.Argument("(value.map: "+extensionValueCopy("it")+")"),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.StartCall("else if"),
+		w.Argument("value is _protobuf.Message and has_extension extension"),
+		w.StartBlock(false),
+		w.StartCall("(get_extension extension).merge_from"),
+		w.Argument("value"),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.StartCall("else"),
+		w.StartBlock(false),
+		w.StartCall("set_extension"),
+		w.Argument("extension"),
+		w.Argument("("+extensionValueCopy("value")+")"),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+)
+
+func TestSerializeOrder(t *testing.T) {
+	tests := []struct {
+		fields []int32
+		ranges [][2]int32
+		// want lists the field numbers, and the extension groups as from-to.
+		want []string
+	}{
+		{[]int32{2, 1}, nil, []string{"1", "2"}},
+		{[]int32{1}, [][2]int32{{100, 200}}, []string{"1", "100-200"}},
+		{nil, [][2]int32{{100, 200}}, []string{"100-200"}},
+		{[]int32{1, 200}, [][2]int32{{300, 400}, {100, 200}}, []string{"1", "100-200", "200", "300-400"}},
+		{[]int32{1, 300}, [][2]int32{{100, 200}, {200, 300}}, []string{"1", "100-300", "300"}},
+		{[]int32{150}, [][2]int32{{100, 150}, {151, 200}}, []string{"100-150", "150", "151-200"}},
+	}
+	for _, test := range tests {
+		var fields []*fieldType
+		for _, number := range test.fields {
+			fields = append(fields, &fieldType{field: &descriptor.FieldDescriptorProto{Number: proto.Int32(number)}})
+		}
+		var ranges []*descriptor.DescriptorProto_ExtensionRange
+		for _, r := range test.ranges {
+			ranges = append(ranges, &descriptor.DescriptorProto_ExtensionRange{Start: proto.Int32(r[0]), End: proto.Int32(r[1])})
+		}
+
+		var have []string
+		for _, step := range serializeOrder(fields, ranges) {
+			if step.field != nil {
+				have = append(have, fmt.Sprint(step.field.field.GetNumber()))
+			} else {
+				have = append(have, fmt.Sprintf("%d-%d", step.from, step.to))
+			}
+		}
+		if !reflect.DeepEqual(have, test.want) {
+			t.Errorf("fields=%v ranges=%v: have %v, want %v", test.fields, test.ranges, have, test.want)
+		}
+	}
+}
+
+func TestWriteMergeExtensions(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	w := toit.NewWriter(buffer)
+	g := &generator{options: generatorOptions{Extensions: true}}
+	if err := g.writeMergeExtensions(w); err != nil {
+		t.Fatal(err)
+	}
+
+	// Message values are merged into an existing value, and copied otherwise,
+	// so a merged message never shares a value with the message it came from.
+	want := `if other.extensions_:
+  other.extensions_.do: | extension value | 
+    if value is List:
+      if not has_extension extension:
+        set_extension extension []
+      (get_extension extension).add_all (value.map: it is _protobuf.Message or it is ByteArray ? it.copy : it)
+    else if value is _protobuf.Message and has_extension extension:
+      (get_extension extension).merge_from value
+    else:
+      set_extension extension (value is _protobuf.Message or value is ByteArray ? value.copy : value)
+`
+	if have := buffer.String(); have != want {
+		t.Errorf("have:\n%s\nwant:\n%s", have, want)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"strings"
+
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+const coreFieldMaskMessage = ".google.protobuf.FieldMask"
+
+// fieldMaskHelperNames are the members every message gets for working with
+// field masks.
+var fieldMaskHelperNames = []string{"is_valid_field_mask_path", "validate_field_mask", "merge_masked"}
+
+// maskedField is a field that can be named by a field mask path.
+type maskedField struct {
+	// Path is the name of the field in field mask paths.
+	Path      string
+	FieldName string
+	FieldType *fieldType
+	Oneof     *oneofType
+	// Nested is the class of the message, if the path may continue into the
+	// fields of the message.
+	Nested string
+}
+
+func (g *generator) resolveMaskedFields(fields []*fieldType, oneofTypes []*oneofType) ([]*maskedField, error) {
+	var res []*maskedField
+	for _, fieldType := range fields {
+		f := &maskedField{
+			Path:      fieldType.field.GetName(),
+			FieldName: fieldType.FieldName(oneofTypes),
+			FieldType: fieldType,
+		}
+		if fieldType.IsOneof() {
+			f.Oneof = oneofTypes[fieldType.field.GetOneofIndex()]
+		}
+		if fieldType.class == fieldTypeClassObject && !g.isCoreObject(fieldType) {
+			nested, err := g.methodMessageType(fieldType.field.GetTypeName())
+			if err != nil {
+				return nil, err
+			}
+			f.Nested = nested
+		}
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+func (g *generator) writeFieldMaskHelpers(w *toit.Writer, className string, fields []*fieldType, oneofTypes []*oneofType) error {
+	maskedFields, err := g.resolveMaskedFields(fields, oneofTypes)
+	if err != nil {
+		return err
+	}
+	return util.FirstError(
+		g.writeIsValidFieldMaskPath(w, maskedFields),
+		g.writeValidateFieldMask(w),
+		g.writeMergeMasked(w, className, maskedFields, oneofTypes),
+	)
+}
+
+// writeFieldMaskPathName splits the first field name off a field mask path.
+func writeFieldMaskPathName(w *toit.Writer) error {
+	return util.FirstError(
+		w.Variable("dot", "", `path.index_of "."`),
+		w.Variable("name", "", "dot < 0 ? path : path[..dot]"),
+	)
+}
+
+func (g *generator) writeIsValidFieldMaskPath(w *toit.Writer, maskedFields []*maskedField) error {
+	if err := util.FirstError(
+		w.StartStaticFunctionDecl("is_valid_field_mask_path"),
+		w.Parameter("path", "string"),
+		w.EndFunctionDecl("bool"),
+	); err != nil {
+		return err
+	}
+
+	if len(maskedFields) > 0 {
+		if err := writeFieldMaskPathName(w); err != nil {
+			return err
+		}
+	}
+	for _, f := range maskedFields {
+		valid := "dot < 0"
+		if f.Nested != "" {
+			valid += " or (" + f.Nested + ".is_valid_field_mask_path path[dot + 1..])"
+		}
+		if err := util.FirstError(
+			w.StartCall("if"),
+			w.Argument("name == "+`"`+f.Path+`"`),
+			w.StartBlock(false),
+			w.ReturnStart(),
+			w.Argument(valid),
+			w.ReturnEnd(),
+			w.EndBlock(false),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		w.ReturnStart(),
+		w.Argument("false"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+	)
+}
+
+func (g *generator) writeValidateFieldMask(w *toit.Writer) error {
+	return util.FirstError(
+		w.StartStaticFunctionDecl("validate_field_mask"),
+		w.Parameter("mask", "List"),
+		w.EndFunctionDecl("none"),
+		w.StartCall("mask.do"),
+		w.StartBlock(false, "path/string"),
+		w.StartCall("if"),
+		w.Argument("not is_valid_field_mask_path path"),
+		w.StartBlock(false),
+		w.StartCall("throw"),
+		w.Argument(`"INVALID_ARGUMENT: $path"`),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.EndFunction(),
+	)
+}
+
+// writeMergeMasked writes a method that copies the fields named by a field
+// mask from another instance. Message fields named by a path are merged into
+// the existing message, and paths that continue into a message field are
+// applied to the existing message.
+func (g *generator) writeMergeMasked(w *toit.Writer, className string, maskedFields []*maskedField, oneofTypes []*oneofType) error {
+	if err := util.FirstError(
+		w.StartFunctionDecl("merge_masked"),
+		w.Parameter("other", className),
+		w.Parameter("mask", "List"),
+		w.EndFunctionDecl("none"),
+		w.StartCall("validate_field_mask"),
+		w.Argument("mask"),
+		w.EndCall(true),
+	); err != nil {
+		return err
+	}
+	if len(maskedFields) == 0 {
+		return w.EndFunction()
+	}
+
+	if err := util.FirstError(
+		w.StartCall("mask.do"),
+		w.StartBlock(false, "path/string"),
+		writeFieldMaskPathName(w),
+	); err != nil {
+		return err
+	}
+
+	for i, f := range maskedFields {
+		if err := util.FirstError(
+			w.StartCall(ifElse(i)),
+			w.Argument("name == "+`"`+f.Path+`"`),
+			w.StartBlock(false),
+		); err != nil {
+			return err
+		}
+
+		if f.Nested == "" {
+			if err := g.writeMaskedLeaf(w, f, oneofTypes); err != nil {
+				return err
+			}
+		} else {
+			if err := util.FirstError(
+				w.StartCall("if"),
+				w.Argument("dot < 0"),
+				w.StartBlock(false),
+				g.writeMaskedLeaf(w, f, oneofTypes),
+				w.EndBlock(false),
+				w.EndCall(true),
+				g.writeMaskedNested(w, f),
+			); err != nil {
+				return err
+			}
+		}
+
+		if err := util.FirstError(
+			w.EndBlock(false),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.EndFunction(),
+	)
+}
+
+// writeMaskedLeaf applies a path that ends at the given field. Messages are
+// merged with the same semantics as merge_from, other fields are copied.
+func (g *generator) writeMaskedLeaf(w *toit.Writer, f *maskedField, oneofTypes []*oneofType) error {
+	if f.FieldType.class == fieldTypeClassObject {
+		return g.writeMergeField(w, f.FieldType, oneofTypes)
+	}
+	return g.writeMaskedCopy(w, f)
+}
+
+// writeMaskedNested applies the rest of a path to the message of a field. A
+// message in a oneof is created first if the other instance holds it.
+func (g *generator) writeMaskedNested(w *toit.Writer, f *maskedField) error {
+	rest := "[path[dot + 1..]]"
+	if f.Oneof == nil {
+		return util.FirstError(
+			w.StartCall("else"),
+			w.StartBlock(false),
+			w.StartCall("this."+f.FieldName+".merge_masked"),
+			w.Argument("other."+f.FieldName),
+			w.Argument(rest),
+			w.EndCall(true),
+			w.EndBlock(false),
+			w.EndCall(true),
+		)
+	}
+
+	constant := strings.ToUpper(f.FieldName)
+	return util.FirstError(
+		w.StartCall("else if"),
+		w.Argument("other."+f.Oneof.CaseGetter+" == "+constant),
+		w.StartBlock(false),
+		w.StartCall("if"),
+		w.Argument("this."+f.Oneof.CaseGetter+" != "+constant),
+		w.StartBlock(false),
+		w.StartAssignment("this."+f.FieldName),
+		w.Argument(f.Nested),
+		w.EndAssignment(),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.StartCall("this."+f.FieldName+".merge_masked"),
+		w.Argument("other."+f.FieldName),
+		w.Argument(rest),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.StartCall("else if"),
+		w.Argument("this."+f.Oneof.CaseGetter+" == "+constant),
+		w.StartBlock(false),
+		w.StartCall("this."+f.FieldName+".merge_masked"),
+		w.Argument(f.Nested),
+		w.Argument(rest),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
+
+// writeMaskedCopy copies a single field from the other instance, including
+// whether it is set. Mutable values are copied so the instances do not share
+// them.
+func (g *generator) writeMaskedCopy(w *toit.Writer, f *maskedField) error {
+	var isSet, isSetHere, clear string
+	switch {
+	case f.Oneof != nil:
+		constant := strings.ToUpper(f.FieldName)
+		isSet = "other." + f.Oneof.CaseGetter + " == " + constant
+		isSetHere = "this." + f.Oneof.CaseGetter + " == " + constant
+		clear = f.Oneof.ClearFunction
+	case f.FieldType.presence != nil:
+		isSet = "other.has_" + f.FieldName
+		clear = "clear_" + f.FieldName
+	default:
+		return util.FirstError(
+			w.StartAssignment("this."+f.FieldName),
+			w.Argument(g.copyExpression(f.FieldType, "other."+f.FieldName)),
+			w.EndAssignment(),
+		)
+	}
+
+	elseCall := "else"
+	if isSetHere != "" {
+		// Clearing the oneof is only correct if it holds this field.
+		elseCall = "else if"
+	}
+	return util.FirstError(
+		w.StartCall("if"),
+		w.Argument(isSet),
+		w.StartBlock(false),
+		w.StartAssignment("this."+f.FieldName),
+		w.Argument(g.copyExpression(f.FieldType, "other."+f.FieldName)),
+		w.EndAssignment(),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.StartCall(elseCall),
+		func() error {
+			if isSetHere == "" {
+				return nil
+			}
+			return w.Argument(isSetHere)
+		}(),
+		w.StartBlock(false),
+		w.StartCall("this."+clear),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
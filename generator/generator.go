@@ -27,6 +27,34 @@ const (
 	// core_objects (bool), if set, will decode core protobuf messages into their toit counterparts (Timestamp and Duration).
 	// enabled by default.
 	coreObjectsParam = "core_objects"
+	// deterministic (bool), if set, will serialize map entries sorted by key.
+	deterministicParam = "deterministic"
+	// services (bool), if set, will generate clients and handlers for services.
+	servicesParam = "services"
+	// unknown_fields (bool), if set, will keep the fields that are not part of a message when it is deserialized.
+	unknownFieldsParam = "unknown_fields"
+	// extensions (bool), if set, will generate proto2 extensions and the accessors of extendable messages.
+	extensionsParam = "extensions"
+	// wrappers (bool), if set together with core_objects, will map the wrapper messages to nullable primitives.
+	wrappersParam = "wrappers"
+	// struct (bool), if set together with core_objects, will map Struct, ListValue and Value to Map, List and any.
+	structParam = "struct"
+	// any (bool), if set, will generate helpers to pack messages into Any messages and map Any to _protobuf.Any.
+	anyParam = "any"
+	// field_mask (bool), if set together with core_objects, will map FieldMask to a list of paths.
+	fieldMaskParam = "field_mask"
+	// json (bool), if set, will generate to_json and from_json for the proto3 JSON mapping.
+	jsonParam = "json"
+	// text_format (bool), if set, will generate methods to print and parse messages in the protobuf text format.
+	textFormatParam = "text_format"
+	// equality (bool), if set, will generate structural == operators and hash_code methods.
+	equalityParam = "equality"
+	// packed (bool), if set, will write repeated scalar fields with the encoding of their .proto file.
+	packedParam = "packed"
+	// groups (bool), if set, will generate proto2 group fields instead of failing on them.
+	groupsParam = "groups"
+	// closed_enums (bool), if set, will keep values of proto2 enum fields that the enum doesn't define with the unknown fields.
+	closedEnumsParam = "closed_enums"
 
 	protoLibrary         = "protogen"
 	coreDurationMessage  = ".google.protobuf.Duration"
@@ -39,42 +67,73 @@ type generator struct {
 	importResolver *importResolver
 	types          map[string]*referType
 	imports        map[string]string
+	// file is the file currently being generated.
+	file *descriptor.FileDescriptorProto
+	// comments holds the comments of the descriptors in file.
+	comments map[interface{}]string
 }
 
 type generatorOptions struct {
 	ConstructorInitializers bool
 	ConvertHooks            bool
 	CoreObjects             bool
+	Deterministic           bool
+	Services                bool
+	UnknownFields           bool
+	Extensions              bool
+	Wrappers                bool
+	Struct                  bool
+	Any                     bool
+	FieldMask               bool
+	JSON                    bool
+	TextFormat              bool
+	Equality                bool
+	Packed                  bool
+	Groups                  bool
+	ClosedEnums             bool
 	ImportLibraries         map[string]string
 }
 
+// parseBoolOption sets value to the boolean given for the option, if the
+// option is present.
+func parseBoolOption(params map[string]string, name string, value *bool) error {
+	v, ok := params[name]
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("failed to parse '%s' option reason: %w", name, err)
+	}
+	*value = b
+	return nil
+}
+
 func parseGeneratorOptions(params map[string]string) (generatorOptions, error) {
 	options := generatorOptions{
 		ImportLibraries: map[string]string{},
 		CoreObjects:     true,
 	}
-	if v, ok := params[constructorInitializersParam]; ok {
-		b, err := strconv.ParseBool(v)
-		if err != nil {
-			return options, fmt.Errorf("failed to parse '%s' option reason: %w", constructorInitializersParam, err)
-		}
-		options.ConstructorInitializers = b
-	}
-
-	if v, ok := params[convertHooksParam]; ok {
-		b, err := strconv.ParseBool(v)
-		if err != nil {
-			return options, fmt.Errorf("failed to parse '%s' option reason: %w", convertHooksParam, err)
-		}
-		options.ConvertHooks = b
-	}
-
-	if v, ok := params[coreObjectsParam]; ok {
-		b, err := strconv.ParseBool(v)
-		if err != nil {
-			return options, fmt.Errorf("failed to parse '%s' option reason: %w", coreObjectsParam, err)
-		}
-		options.CoreObjects = b
+	if err := util.FirstError(
+		parseBoolOption(params, constructorInitializersParam, &options.ConstructorInitializers),
+		parseBoolOption(params, convertHooksParam, &options.ConvertHooks),
+		parseBoolOption(params, coreObjectsParam, &options.CoreObjects),
+		parseBoolOption(params, deterministicParam, &options.Deterministic),
+		parseBoolOption(params, servicesParam, &options.Services),
+		parseBoolOption(params, unknownFieldsParam, &options.UnknownFields),
+		parseBoolOption(params, extensionsParam, &options.Extensions),
+		parseBoolOption(params, wrappersParam, &options.Wrappers),
+		parseBoolOption(params, structParam, &options.Struct),
+		parseBoolOption(params, anyParam, &options.Any),
+		parseBoolOption(params, fieldMaskParam, &options.FieldMask),
+		parseBoolOption(params, jsonParam, &options.JSON),
+		parseBoolOption(params, textFormatParam, &options.TextFormat),
+		parseBoolOption(params, equalityParam, &options.Equality),
+		parseBoolOption(params, packedParam, &options.Packed),
+		parseBoolOption(params, groupsParam, &options.Groups),
+		parseBoolOption(params, closedEnumsParam, &options.ClosedEnums),
+	); err != nil {
+		return options, err
 	}
 
 	if v, ok := params[importLibraryParam]; ok {
@@ -182,9 +241,19 @@ func uniqueName(name string, namespace util.StringSet, prefix string) string {
 }
 
 var (
-	reservedFieldNames = util.NewStringSet("operator", "static", "class", "constructor", "interface")
+	reservedFieldNames = newReservedFieldNames()
 )
 
+// newReservedFieldNames returns the names that fields are renamed away from:
+// Toit keywords and the helpers that are generated for every message.
+func newReservedFieldNames() util.StringSet {
+	res := util.NewStringSet("operator", "static", "class", "constructor", "interface")
+	res.Add(fieldMaskHelperNames...)
+	res.Add(mergeHelperNames...)
+	res.Add(requiredHelperNames...)
+	return res
+}
+
 func (g *generator) generateFile(file *descriptor.FileDescriptorProto) (*plugin.CodeGeneratorResponse_File, error) {
 	resp := &plugin.CodeGeneratorResponse_File{}
 	resp.Name = util.StringPtr(protoToFile(file.GetName()))
@@ -197,6 +266,9 @@ func (g *generator) generateFile(file *descriptor.FileDescriptorProto) (*plugin.
 
 	w.NewLine()
 
+	g.file = file
+	g.comments = resolveComments(file)
+
 	// create imports
 	g.imports[file.GetName()] = ""
 	w.ImportAs("encoding.protobuf", "_protobuf")
@@ -230,6 +302,26 @@ func (g *generator) generateFile(file *descriptor.FileDescriptorProto) (*plugin.
 		}
 	}
 
+	if err := g.writeExtensions(w, file, typePath...); err != nil {
+		return nil, err
+	}
+
+	if err := g.writeRegisterTypes(w, file, typePath...); err != nil {
+		return nil, err
+	}
+
+	if g.options.Services {
+		definedNames, err := g.fileDefinedNames(file, typePath...)
+		if err != nil {
+			return nil, err
+		}
+		for _, service := range file.GetService() {
+			if err := g.writeService(w, file, service, definedNames, typePath...); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	resp.Content = util.StringPtr(buffer.String())
 
 	return resp, nil
@@ -252,6 +344,7 @@ func (g *generator) writeOneof(w *toit.Writer, msg *descriptor.DescriptorProto,
 	typeName := typeName(oneof.GetName(), typePath...)
 	if err := util.FirstError(
 		w.SingleLineComment("ONEOF START: "+typeName),
+		g.writeComment(w, oneof),
 		w.Variable(res.FieldName, "", "null"),
 		w.Variable(res.CaseName, "int?", "null"),
 		w.NewLine(),
@@ -314,6 +407,7 @@ func (g *generator) writeOneof(w *toit.Writer, msg *descriptor.DescriptorProto,
 
 		if err := util.FirstError(
 			// Getter
+			g.writeComment(w, field),
 			w.StartFunctionDecl(fieldName),
 			w.EndFunctionDecl(t),
 			w.ReturnStart(),
@@ -349,7 +443,15 @@ func (g *generator) writeEnum(w *toit.Writer, enum *descriptor.EnumDescriptorPro
 	className := typ.ToitType("")
 	w.SingleLineComment("ENUM START: " + className)
 	for _, value := range enum.GetValue() {
-		w.Const(toitClassName(value.GetName(), className), "int/*enum<"+className+">*/", strconv.Itoa(int(value.GetNumber())))
+		if err := util.FirstError(
+			g.writeComment(w, value),
+			w.Const(toitClassName(value.GetName(), className), "int/*enum<"+className+">*/", strconv.Itoa(int(value.GetNumber()))),
+		); err != nil {
+			return err
+		}
+	}
+	if err := g.writeEnumClass(w, enum, className); err != nil {
+		return err
 	}
 	w.SingleLineComment("ENUM END: " + typeName)
 	w.NewLine()
@@ -385,9 +487,15 @@ func (g *generator) writeMessage(w *toit.Writer, msg *descriptor.DescriptorProto
 
 	definedNames := util.NewStringSet()
 
+	if err := g.writeComment(w, msg); err != nil {
+		return err
+	}
 	w.StartClass(className, "_protobuf.Message")
 	var oneofTypes []*oneofType
 	for i := range msg.GetOneofDecl() {
+		if isSyntheticOneof(msg, i) {
+			continue
+		}
 		oneof := msg.OneofDecl[i]
 		oneofType, err := g.writeOneof(w, msg, oneof, recTypePath...)
 		if err != nil {
@@ -396,46 +504,90 @@ func (g *generator) writeMessage(w *toit.Writer, msg *descriptor.DescriptorProto
 		oneofTypes = append(oneofTypes, oneofType)
 
 		if definedNames.Contains(oneofType.FieldName) {
-			return fmt.Errorf("name clash for for oneof field: %v", oneofType.FieldName)
+			return fmt.Errorf("name clash for oneof field: %v", oneofType.FieldName)
 		}
 		if definedNames.Contains(oneofType.CaseName) {
-			return fmt.Errorf("name clash for for oneof case field: %v", oneofType.CaseName)
+			return fmt.Errorf("name clash for oneof case field: %v", oneofType.CaseName)
 		}
 		if definedNames.Contains(oneofType.CaseGetter) {
-			return fmt.Errorf("name clash for for oneof case getter: %v", oneofType.CaseGetter)
+			return fmt.Errorf("name clash for oneof case getter: %v", oneofType.CaseGetter)
 		}
 		definedNames.Add(oneofType.FieldName, oneofType.CaseGetter, oneofType.CaseName)
 
 		for _, fieldName := range oneofType.CaseFields {
 			constant := strings.ToUpper(fieldName)
 			if definedNames.Contains(constant) {
-				return fmt.Errorf("name clash for for oneof constant: %v", constant)
+				return fmt.Errorf("name clash for oneof constant: %v", constant)
 			}
 			if definedNames.Contains(fieldName) {
-				return fmt.Errorf("name clash for for oneof getter: %v", fieldName)
+				return fmt.Errorf("name clash for oneof getter: %v", fieldName)
 			}
 			setter := fieldName + "="
 			if definedNames.Contains(setter) {
-				return fmt.Errorf("name clash for for oneof setter: %v", setter)
+				return fmt.Errorf("name clash for oneof setter: %v", setter)
 			}
 			definedNames.Add(constant, fieldName, setter)
 		}
 	}
 
+	if g.options.UnknownFields {
+		if definedNames.Contains(unknownFieldsName) {
+			return fmt.Errorf("name clash for unknown fields: %v", unknownFieldsName)
+		}
+		definedNames.Add(unknownFieldsName)
+	}
+
+	// The helper members that are generated for every message.
+	var helperNames [][]string
+	if g.options.Any {
+		helperNames = append(helperNames, anyHelperNames)
+	}
+	if g.options.JSON {
+		helperNames = append(helperNames, jsonHelperNames)
+	}
+	if g.options.TextFormat {
+		helperNames = append(helperNames, textHelperNames, parseTextHelperNames)
+	}
+	if g.options.Equality {
+		helperNames = append(helperNames, equalityHelperNames)
+	}
+	helperNames = append(helperNames, requiredHelperNames, mergeHelperNames, fieldMaskHelperNames)
+	for _, names := range helperNames {
+		for _, name := range names {
+			if definedNames.Contains(name) {
+				return fmt.Errorf("name clash for helper: %v", name)
+			}
+			definedNames.Add(name)
+		}
+	}
+
+	// The full name of the message, if other messages can extend it.
+	extendee := ""
+	if g.options.Extensions && len(msg.GetExtensionRange()) > 0 {
+		extendee = strings.TrimPrefix(typeName, ".")
+		for _, name := range []string{extensionsName, "get_extension", "set_extension", "has_extension", "clear_extension"} {
+			if definedNames.Contains(name) {
+				return fmt.Errorf("name clash for extension accessor: %v", name)
+			}
+			definedNames.Add(name)
+		}
+	}
+
 	var fields []*fieldType
+	var presenceFields []*fieldType
 	for _, field := range msg.GetField() {
 		fieldType, err := g.resolveFieldType(field, false)
 		if err != nil {
 			return err
 		}
 		fields = append(fields, fieldType)
-		if field.OneofIndex != nil {
+		if fieldType.IsOneof() {
 			continue
 		}
 
 		fieldName := uniqueName(field.GetName(), reservedFieldNames, "_")
 		if definedNames.Contains(fieldName) {
-			return fmt.Errorf("name clash for for field: %v", fieldName)
+			return fmt.Errorf("name clash for field: %v", fieldName)
 		}
 		definedNames.Add(fieldName)
 
@@ -448,12 +600,64 @@ func (g *generator) writeMessage(w *toit.Writer, msg *descriptor.DescriptorProto
 		if err != nil {
 			return err
 		}
+
+		if g.hasPresence(fieldType) {
+			for _, name := range []string{fieldName + "_", fieldName + "=", "has_" + fieldName, "clear_" + fieldName} {
+				if definedNames.Contains(name) {
+					return fmt.Errorf("name clash for field accessor: %v", name)
+				}
+				definedNames.Add(name)
+			}
+			fieldType.presence = newPresenceType(len(presenceFields))
+			presenceFields = append(presenceFields, fieldType)
+			if g.isRecursiveField(typ, fieldType) {
+				// Allocating the message together with its parent would never terminate.
+				fieldType.lazy = true
+				t, defaultValue = t+"?", "null"
+			}
+			w.Variable(fieldName+"_", t, defaultValue)
+			continue
+		}
+		if err := g.writeComment(w, field); err != nil {
+			return err
+		}
 		w.Variable(fieldName, t, defaultValue)
 	}
+	if extendee != "" {
+		if err := w.Variable(extensionsName, "Map?/*<_protobuf.Extension, any>*/", "null"); err != nil {
+			return err
+		}
+	}
+	if err := g.writeUnknownFieldsVariable(w); err != nil {
+		return err
+	}
+	if err := g.writePresenceWords(w, len(presenceFields)); err != nil {
+		return err
+	}
 	w.NewLine()
 
+	for _, fieldType := range presenceFields {
+		if err := g.writePresenceAccessors(w, fieldType); err != nil {
+			return err
+		}
+	}
+
+	if extendee != "" {
+		if err := g.writeExtensionAccessors(w, extendee); err != nil {
+			return err
+		}
+	}
+
+	if err := g.writeAnyHelpers(w, className, typeName); err != nil {
+		return err
+	}
+
+	if err := g.writeFieldMaskHelpers(w, className, fields, oneofTypes); err != nil {
+		return err
+	}
+
 	if g.options.ConvertHooks {
-		if err := g.writeDeserializeIntoMethod(w, className, fields, oneofTypes); err != nil {
+		if err := g.writeDeserializeIntoMethod(w, className, extendee, fields, oneofTypes); err != nil {
 			return err
 		}
 	}
@@ -462,7 +666,15 @@ func (g *generator) writeMessage(w *toit.Writer, msg *descriptor.DescriptorProto
 		return err
 	}
 
-	if err := g.writeDeserializeConstructor(w, fields, oneofTypes); err != nil {
+	if err := g.writeDeserializeConstructor(w, extendee, g.checksRequiredFields(typ), fields, oneofTypes); err != nil {
+		return err
+	}
+
+	if err := g.writeFromJSONConstructor(w, g.checksRequiredFields(typ), fields, oneofTypes); err != nil {
+		return err
+	}
+
+	if err := g.writeParseTextMethods(w, className, g.checksRequiredFields(typ), fields, oneofTypes); err != nil {
 		return err
 	}
 
@@ -472,15 +684,47 @@ func (g *generator) writeMessage(w *toit.Writer, msg *descriptor.DescriptorProto
 		}
 	}
 
-	if err := g.writeSerializeMethod(w, fields, oneofTypes); err != nil {
+	if err := g.writeInitializedMethods(w, typ, fields, oneofTypes); err != nil {
+		return err
+	}
+
+	var extensionRanges []*descriptor.DescriptorProto_ExtensionRange
+	if extendee != "" {
+		extensionRanges = msg.GetExtensionRange()
+	}
+	if err := g.writeSerializeMethod(w, extensionRanges, g.checksRequiredFields(typ), fields, oneofTypes); err != nil {
+		return err
+	}
+
+	if err := g.writeNumFieldsSetMethod(w, extendee, fields, oneofTypes); err != nil {
+		return err
+	}
+
+	if err := g.writeProtobufSizeMethod(w, extendee, fields, oneofTypes); err != nil {
+		return err
+	}
+
+	if err := g.writeToJSONMethod(w, fields, oneofTypes); err != nil {
+		return err
+	}
+
+	if err := g.writeTextMethods(w, fields, oneofTypes); err != nil {
+		return err
+	}
+
+	if err := g.writeCopyMethod(w, className); err != nil {
+		return err
+	}
+
+	if err := g.writeMergeFromMethod(w, className, extendee, fields, oneofTypes); err != nil {
 		return err
 	}
 
-	if err := g.writeNumFieldsSetMethod(w, fields, oneofTypes); err != nil {
+	if err := g.writeEqualsOperator(w, className, extendee, fields, oneofTypes); err != nil {
 		return err
 	}
 
-	if err := g.writeProtobufSizeMethod(w, fields, oneofTypes); err != nil {
+	if err := g.writeHashCodeMethod(w, extendee, fields, oneofTypes); err != nil {
 		return err
 	}
 
@@ -542,14 +786,18 @@ func (g *generator) writeDefaultConstructor(w *toit.Writer, fields []*fieldType,
 	return w.EndConstructor()
 }
 
-func (g *generator) writeDeserializeConstructor(w *toit.Writer, fields []*fieldType, oneofTypes []*oneofType) error {
+// writeDeserializeConstructor writes the deserialize constructor. For messages
+// with required fields, the constructor checks that they are set unless it is
+// called for a nested message, which is checked as part of its parent.
+func (g *generator) writeDeserializeConstructor(w *toit.Writer, extendee string, checkRequired bool, fields []*fieldType, oneofTypes []*oneofType) error {
 	return util.FirstError(
 		w.StartConstructorDecl("deserialize"),
 		w.Parameter("r", "_protobuf.Reader"),
+		writeCheckInitializedParameter(w, checkRequired),
 		w.EndConstructorDecl(),
 		func() error {
 			if !g.options.ConvertHooks {
-				return g.writeDeserializeBody(w, "", fields, oneofTypes)
+				return g.writeDeserializeBody(w, "", extendee, fields, oneofTypes)
 			}
 			return util.FirstError(
 				w.StartCall("deserialize_into"),
@@ -558,17 +806,18 @@ func (g *generator) writeDeserializeConstructor(w *toit.Writer, fields []*fieldT
 				w.EndCall(true),
 			)
 		}(),
+		writeCheckInitialized(w, checkRequired, "this"),
 		w.EndConstructor(),
 	)
 }
 
-func (g *generator) writeDeserializeIntoMethod(w *toit.Writer, objectType string, fields []*fieldType, oneofTypes []*oneofType) error {
+func (g *generator) writeDeserializeIntoMethod(w *toit.Writer, objectType string, extendee string, fields []*fieldType, oneofTypes []*oneofType) error {
 	return util.FirstError(
 		w.StartStaticFunctionDecl("deserialize_into"),
 		w.Parameter("r", "_protobuf.Reader"),
 		w.Parameter("obj", objectType),
 		w.EndFunctionDecl(objectType),
-		g.writeDeserializeBody(w, "obj", fields, oneofTypes),
+		g.writeDeserializeBody(w, "obj", extendee, fields, oneofTypes),
 		w.ReturnStart(),
 		w.Argument("obj"),
 		w.ReturnEnd(),
@@ -695,19 +944,23 @@ func (g *generator) writeSerializeFieldMethod(w *toit.Writer, fieldType *fieldTy
 	)
 }
 
-func (g *generator) writeDeserializeBody(w *toit.Writer, objectName string, fields []*fieldType, oneOfTypes []*oneofType) error {
+func (g *generator) writeDeserializeBody(w *toit.Writer, objectName string, extendee string, fields []*fieldType, oneOfTypes []*oneofType) error {
 	w.StartCall("r.read_message")
 	w.StartBlock(false)
 
-	if len(fields) == 0 {
-		w.Literal("1")
-	} else {
-		for _, fieldType := range fields {
-			if err := g.writeReadFieldCall(w, objectName, fieldType, oneOfTypes); err != nil {
-				return err
-			}
+	for _, fieldType := range fields {
+		if err := g.writeReadFieldCall(w, objectName, fieldType, oneOfTypes); err != nil {
+			return err
 		}
 	}
+	if extendee != "" {
+		if err := g.writeReadExtensionCall(w, objectName, extendee); err != nil {
+			return err
+		}
+	}
+	if err := g.writeReadUnknownFieldCall(w, objectName); err != nil {
+		return err
+	}
 
 	w.EndBlock(false)
 	w.EndCall(true)
@@ -717,6 +970,9 @@ func (g *generator) writeDeserializeBody(w *toit.Writer, objectName string, fiel
 func (g *generator) writeReadFieldCall(w *toit.Writer, objectName string, fieldType *fieldType, oneofTypes []*oneofType) error {
 	w.StartCall("r.read_field")
 	w.Argument(strconv.Itoa(int(fieldType.field.GetNumber())))
+	if err := g.writeClosedEnumArgument(w, fieldType); err != nil {
+		return err
+	}
 	w.StartBlock(false)
 	if err := g.writeReadFieldAssignment(w, objectName, fieldType, oneofTypes); err != nil {
 		return err
@@ -780,22 +1036,13 @@ func (g *generator) writeReadFieldType(w *toit.Writer, objectName string, fieldN
 			w.EndCall(true),
 		)
 	case fieldTypeClassObject:
-		if g.options.CoreObjects {
-			fnName := ""
-			if fieldType.t.Name() == coreDurationMessage {
-				fnName = "_protobuf.deserialize_duration"
-			}
-			if fieldType.t.Name() == coreTimestampMessage {
-				fnName = "_protobuf.deserialize_timestamp"
-			}
-
-			if fnName != "" {
-				return util.FirstError(
-					w.StartCall(fnName),
-					w.Argument("r"),
-					w.EndCall(true),
-				)
-			}
+		if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+			return util.FirstError(
+				w.StartCall(coreObject.Deserialize),
+				writeArguments(w, coreObject.Arguments),
+				w.Argument("r"),
+				w.EndCall(true),
+			)
 		}
 
 		importAlias, ok := g.imports[fieldType.t.file.GetName()]
@@ -812,9 +1059,12 @@ func (g *generator) writeReadFieldType(w *toit.Writer, objectName string, fieldN
 			)
 		}
 
+		// Groups are read like other messages. The reader recognizes them by
+		// their wire type.
 		return util.FirstError(
 			w.StartCall(toitClass+".deserialize"),
 			w.Argument("r"),
+			g.writeNoCheckInitializedArgument(w, fieldType),
 			w.EndCall(true),
 		)
 	case fieldTypeClassPrimitive:
@@ -832,40 +1082,75 @@ func (g *generator) writeReadFieldType(w *toit.Writer, objectName string, fieldN
 	}
 }
 
-func (g *generator) writeSerializeMethod(w *toit.Writer, fields []*fieldType, oneOfTypes []*oneofType) error {
+func (g *generator) writeSerializeMethod(w *toit.Writer, extensionRanges []*descriptor.DescriptorProto_ExtensionRange, checkRequired bool, fields []*fieldType, oneOfTypes []*oneofType) error {
 	w.StartFunctionDecl("serialize")
 	w.Parameter("w", "_protobuf.Writer")
 	w.ParameterWithDefault("--as_field", "int?", "null")
 	w.ParameterWithDefault("--oneof", "bool", "false")
+	if checkRequired {
+		w.ParameterWithDefault("--check_initialized", "bool", "true")
+	}
 	w.EndFunctionDecl("none")
 
+	if checkRequired {
+		// Nested messages are checked as part of the top-level message.
+		w.StartCall("if")
+		w.Argument("check_initialized")
+		w.StartBlock(false)
+		w.StartCall("this.check_initialized")
+		w.EndCall(true)
+		w.EndBlock(false)
+		w.EndCall(true)
+	}
+
 	w.StartCall("w.write_message_header")
 	w.Argument("this")
 	w.Argument("--as_field=as_field")
 	w.Argument("--oneof=oneof")
 	w.EndCall(true)
 
-	if len(fields) == 0 {
-		w.Literal("1")
-	} else {
-		for _, fieldType := range fields {
-			if fieldType.field.OneofIndex != nil {
-				if err := g.writeSerializeOneofField(w, fieldType, oneOfTypes); err != nil {
-					return err
-				}
-			} else {
-				if err := g.writeSerializeField(w, fieldType, "", nil, nil, nil); err != nil {
-					return err
-				}
+	steps := serializeOrder(fields, extensionRanges)
+	// A single group of extensions holds all of them, so it needs no bounds.
+	boundExtensions := len(steps)-len(fields) > 1
+	for _, step := range steps {
+		if step.field == nil {
+			if err := g.writeSerializeExtensions(w, step, boundExtensions); err != nil {
+				return err
 			}
+			continue
 		}
+
+		fieldType := step.field
+		if fieldType.IsOneof() {
+			if err := g.writeSerializeOneofField(w, fieldType, oneOfTypes); err != nil {
+				return err
+			}
+			continue
+		}
+
+		condition, err := g.serializeCondition(fieldType, "")
+		if err != nil {
+			return err
+		}
+		if condition != "" {
+			if err := g.writeSerializeGuardedField(w, fieldType, condition); err != nil {
+				return err
+			}
+		} else {
+			if err := g.writeSerializeField(w, fieldType, "", nil, nil, nil, false); err != nil {
+				return err
+			}
+		}
+	}
+	if err := g.writeSerializeUnknownFields(w); err != nil {
+		return err
 	}
 
 	w.EndFunction()
 	return nil
 }
 
-func (g *generator) writeSerializeList(w *toit.Writer, fieldName string, fieldType *fieldType, asField *string, oneofFieldName *string) error {
+func (g *generator) writeSerializeList(w *toit.Writer, fieldName string, fieldType *fieldType, asField *string, oneofFieldName *string, force bool) error {
 	protoType, err := protobufTypeConst(fieldType.valueType.field.GetType())
 	if err != nil {
 		return err
@@ -878,15 +1163,16 @@ func (g *generator) writeSerializeList(w *toit.Writer, fieldName string, fieldTy
 		w.StartCall("w.write_array"),
 		w.Argument("_protobuf."+protoType),
 		w.Argument(g.getSerializeFieldName(fieldName, oneofFieldName, nil)),
-		writeSerializeNamedArguments(w, asField, oneofFieldName != nil),
+		writeSerializeNamedArguments(w, asField, force),
+		g.writePackedArgument(w, fieldType.field),
 		w.StartBlock(false, "value/"+toitType),
-		g.writeSerializeField(w, fieldType.valueType, "value", nil, nil, &fieldName),
+		g.writeSerializeField(w, fieldType.valueType, "value", nil, nil, &fieldName, false),
 		w.EndBlock(false),
 		w.EndCall(true),
 	)
 }
 
-func (g *generator) writeSerializeMap(w *toit.Writer, fieldName string, fieldType *fieldType, asField *string, oneofFieldName *string) error {
+func (g *generator) writeSerializeMap(w *toit.Writer, fieldName string, fieldType *fieldType, asField *string, oneofFieldName *string, force bool) error {
 	keyProtoType, err := protobufTypeConst(fieldType.keyType.field.GetType())
 	if err != nil {
 		return err
@@ -908,24 +1194,43 @@ func (g *generator) writeSerializeMap(w *toit.Writer, fieldName string, fieldTyp
 		w.Argument("_protobuf."+keyProtoType),
 		w.Argument("_protobuf."+valueProtoType),
 		w.Argument(g.getSerializeFieldName(fieldName, oneofFieldName, nil)),
-		writeSerializeNamedArguments(w, asField, oneofFieldName != nil),
+		writeSerializeNamedArguments(w, asField, force),
+		func() error {
+			if !g.options.Deterministic {
+				return nil
+			}
+			return w.NamedArgument("--deterministic", "")
+		}(),
 		w.StartBlock(true, "key/"+keyToitType),
-		g.writeSerializeField(w, fieldType.keyType, "key", nil, nil, &fieldName),
+		g.writeSerializeField(w, fieldType.keyType, "key", nil, nil, &fieldName, false),
 		w.EndBlock(true),
 		w.StartBlock(true, "value/"+valueToitType),
-		g.writeSerializeField(w, fieldType.valueType, "value", nil, nil, &fieldName),
+		g.writeSerializeField(w, fieldType.valueType, "value", nil, nil, &fieldName, false),
 		w.EndBlock(true),
 		w.EndCall(true),
 	)
 }
 
-func writeSerializeNamedArguments(w *toit.Writer, asField *string, oneof bool) error {
+// sortFieldsByNumber returns the fields ordered by field number, which is the
+// order the fields are serialized in.
+func sortFieldsByNumber(fields []*fieldType) []*fieldType {
+	sorted := append([]*fieldType{}, fields...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].field.GetNumber() < sorted[j].field.GetNumber()
+	})
+	return sorted
+}
+
+// writeSerializeNamedArguments writes the arguments that tell the writer
+// which field a value is written as. With force, the value is written even if
+// it is the default value of its type.
+func writeSerializeNamedArguments(w *toit.Writer, asField *string, force bool) error {
 	if asField != nil {
 		if err := w.NamedArgument("--as_field", *asField); err != nil {
 			return err
 		}
 	}
-	if oneof {
+	if force {
 		if err := w.NamedArgument("--oneof", ""); err != nil {
 			return err
 		}
@@ -933,6 +1238,15 @@ func writeSerializeNamedArguments(w *toit.Writer, asField *string, oneof bool) e
 	return nil
 }
 
+func writeArguments(w *toit.Writer, arguments []string) error {
+	for _, argument := range arguments {
+		if err := w.Argument(argument); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (g *generator) getSerializeFieldName(fieldName string, oneofFieldName *string, collectionField *string) string {
 	if !g.options.ConvertHooks {
 		return fieldName
@@ -946,36 +1260,43 @@ func (g *generator) getSerializeFieldName(fieldName string, oneofFieldName *stri
 	return "_serialize_" + fieldName
 }
 
-func (g *generator) writeSerializeMessage(w *toit.Writer, fieldType *fieldType, fieldName string, asField *string, oneofFieldName *string, collectionField *string) error {
-	if g.options.CoreObjects {
-		fnName := ""
-		if fieldType.t.Name() == coreDurationMessage {
-			fnName = "_protobuf.serialize_duration"
-		}
-		if fieldType.t.Name() == coreTimestampMessage {
-			fnName = "_protobuf.serialize_timestamp"
-		}
+func (g *generator) writeSerializeMessage(w *toit.Writer, fieldType *fieldType, fieldName string, asField *string, oneofFieldName *string, collectionField *string, force bool) error {
+	if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+		return util.FirstError(
+			w.StartCall(coreObject.Serialize),
+			writeArguments(w, coreObject.Arguments),
+			w.Argument(fieldName),
+			w.Argument("w"),
+			writeSerializeNamedArguments(w, asField, force),
+			w.EndCall(true),
+		)
+	}
 
-		if fnName != "" {
-			return util.FirstError(
-				w.StartCall(fnName),
-				w.Argument(fieldName),
-				w.Argument("w"),
-				writeSerializeNamedArguments(w, asField, oneofFieldName != nil),
-				w.EndCall(true),
-			)
-		}
+	if fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_GROUP && asField != nil {
+		// Groups are delimited by start and end tags instead of a length.
+		return util.FirstError(
+			w.StartCall("w.write_group"),
+			w.NamedArgument("--as_field", *asField),
+			w.StartBlock(false),
+			w.StartCall(g.getSerializeFieldName(fieldName, oneofFieldName, collectionField)+".serialize"),
+			w.Argument("w"),
+			g.writeNoCheckInitializedArgument(w, fieldType),
+			w.EndCall(true),
+			w.EndBlock(false),
+			w.EndCall(true),
+		)
 	}
 
 	return util.FirstError(
 		w.StartCall(g.getSerializeFieldName(fieldName, oneofFieldName, collectionField)+".serialize"),
 		w.Argument("w"),
-		writeSerializeNamedArguments(w, asField, oneofFieldName != nil),
+		writeSerializeNamedArguments(w, asField, force),
+		g.writeNoCheckInitializedArgument(w, fieldType),
 		w.EndCall(true),
 	)
 }
 
-func (g *generator) writeSerializePrimitive(w *toit.Writer, fieldName string, fieldType *fieldType, asField *string, oneofFieldName *string, collectionField *string) error {
+func (g *generator) writeSerializePrimitive(w *toit.Writer, fieldName string, fieldType *fieldType, asField *string, oneofFieldName *string, collectionField *string, force bool) error {
 	ft := fieldType.field.GetType()
 	protoType, err := protobufTypeConst(ft)
 	if err != nil {
@@ -985,7 +1306,7 @@ func (g *generator) writeSerializePrimitive(w *toit.Writer, fieldName string, fi
 		w.StartCall("w.write_primitive"),
 		w.Argument("_protobuf."+protoType),
 		w.Argument(g.getSerializeFieldName(fieldName, oneofFieldName, collectionField)),
-		writeSerializeNamedArguments(w, asField, oneofFieldName != nil),
+		writeSerializeNamedArguments(w, asField, force),
 		w.EndCall(true),
 	)
 }
@@ -998,13 +1319,51 @@ func (g *generator) writeSerializeOneofField(w *toit.Writer, fieldType *fieldTyp
 		w.StartCall("if"),
 		w.Argument(oneof.CaseName+" == "+fieldConstant),
 		w.StartBlock(false),
-		g.writeSerializeField(w, fieldType, oneof.FieldName, &fieldConstant, &fieldName, nil),
+		g.writeSerializeField(w, fieldType, oneof.FieldName, &fieldConstant, &fieldName, nil, true),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
+
+// serializeCondition returns the condition under which a field that is not
+// part of a oneof must be serialized even if it holds the zero value of its
+// type. An empty condition means the writer decides on its own.
+func (g *generator) serializeCondition(fieldType *fieldType, receiver string) (string, error) {
+	if fieldType.presence != nil {
+		return receiver + "has_" + uniqueName(fieldType.field.GetName(), reservedFieldNames, "_"), nil
+	}
+	if fieldType.class == fieldTypeClassObject && g.isNullableCoreObject(fieldType) {
+		fieldName := uniqueName(fieldType.field.GetName(), reservedFieldNames, "_")
+		return receiver + g.getSerializeFieldName(fieldName, nil, nil) + " != null", nil
+	}
+
+	hasCustomDefault, err := fieldType.HasCustomDefault()
+	if err != nil || !hasCustomDefault {
+		return "", err
+	}
+	defaultValue, err := fieldType.DefaultValue()
+	if err != nil {
+		return "", err
+	}
+	fieldName := uniqueName(fieldType.field.GetName(), reservedFieldNames, "_")
+	return defaultComparison(receiver+g.getSerializeFieldName(fieldName, nil, nil), defaultValue, false), nil
+}
+
+func (g *generator) writeSerializeGuardedField(w *toit.Writer, fieldType *fieldType, condition string) error {
+	fieldName := uniqueName(fieldType.field.GetName(), reservedFieldNames, "_")
+	fieldNumber := strconv.Itoa(int(fieldType.field.GetNumber()))
+	return util.FirstError(
+		w.StartCall("if"),
+		w.Argument(condition),
+		w.StartBlock(false),
+		// The condition already decided that the field is written.
+		g.writeSerializeField(w, fieldType, fieldName, &fieldNumber, nil, nil, true),
 		w.EndBlock(false),
 		w.EndCall(true),
 	)
 }
 
-func (g *generator) writeSerializeField(w *toit.Writer, fieldType *fieldType, fieldName string, asField *string, oneofFieldName *string, collectionField *string) error {
+func (g *generator) writeSerializeField(w *toit.Writer, fieldType *fieldType, fieldName string, asField *string, oneofFieldName *string, collectionField *string, force bool) error {
 	if fieldName == "" {
 		fieldName = uniqueName(fieldType.field.GetName(), reservedFieldNames, "_")
 		fieldNumber := strconv.Itoa(int(fieldType.field.GetNumber()))
@@ -1012,136 +1371,180 @@ func (g *generator) writeSerializeField(w *toit.Writer, fieldType *fieldType, fi
 	}
 	switch fieldType.class {
 	case fieldTypeClassList:
-		return g.writeSerializeList(w, fieldName, fieldType, asField, oneofFieldName)
+		return g.writeSerializeList(w, fieldName, fieldType, asField, oneofFieldName, force)
 	case fieldTypeClassMap:
-		return g.writeSerializeMap(w, fieldName, fieldType, asField, oneofFieldName)
+		return g.writeSerializeMap(w, fieldName, fieldType, asField, oneofFieldName, force)
 	case fieldTypeClassObject:
-		return g.writeSerializeMessage(w, fieldType, fieldName, asField, oneofFieldName, collectionField)
+		return g.writeSerializeMessage(w, fieldType, fieldName, asField, oneofFieldName, collectionField, force)
 	case fieldTypeClassPrimitive:
-		return g.writeSerializePrimitive(w, fieldName, fieldType, asField, oneofFieldName, collectionField)
+		return g.writeSerializePrimitive(w, fieldName, fieldType, asField, oneofFieldName, collectionField, force)
 	default:
 		return fmt.Errorf("unkonwn fieldType: %v for field: %s", fieldType.class, fieldType.field.GetName())
 	}
 }
 
-func (g *generator) writeNumFieldsSetMethod(w *toit.Writer, fields []*fieldType, oneofTypes []*oneofType) error {
-	w.StartFunctionDecl("num_fields_set")
-	w.EndFunctionDecl("int")
-
-	if len(fields) == 0 {
+// writeSum writes a return statement that adds up the terms, one term per
+// line. Without terms the sum is 0.
+func writeSum(w *toit.Writer, terms []func() error) error {
+	if err := w.ReturnStart(); err != nil {
+		return err
+	}
+	if len(terms) == 0 {
 		return util.FirstError(
-			w.ReturnStart(),
 			w.Argument("0"),
 			w.ReturnEnd(),
 			w.EndFunction(),
 		)
 	}
-	w.ReturnStart()
-	w.Argument("")
-	i := 0
-	for _, oneof := range oneofTypes {
+	if err := w.Argument(""); err != nil {
+		return err
+	}
+	for i, term := range terms {
 		if i != 0 {
-			w.Literal("+ ")
+			if err := w.Literal("+ "); err != nil {
+				return err
+			}
 		}
-		w.ConditionExpression(oneof.CaseName+" == null", "0", "1")
-		w.EndLine()
-		i++
+		if err := util.FirstError(
+			term(),
+			w.EndLine(),
+		); err != nil {
+			return err
+		}
+	}
+	return util.FirstError(
+		w.ReturnEnd(),
+		w.EndFunction(),
+	)
+}
+
+func (g *generator) writeNumFieldsSetMethod(w *toit.Writer, extendee string, fields []*fieldType, oneofTypes []*oneofType) error {
+	w.StartFunctionDecl("num_fields_set")
+	w.EndFunctionDecl("int")
+
+	var terms []func() error
+	for _, oneof := range oneofTypes {
+		condition := oneof.CaseName + " == null"
+		terms = append(terms, func() error {
+			return w.ConditionExpression(condition, "0", "1")
+		})
 	}
 
 	for _, fieldType := range fields {
-		if fieldType.field.OneofIndex != nil {
+		if fieldType.IsOneof() {
 			continue
 		}
 
-		fieldName := uniqueName(fieldType.field.GetName(), reservedFieldNames, "_")
-		if g.options.ConvertHooks {
-			fieldName = "_serialize_" + fieldName
+		condition, err := g.isDefaultCondition(fieldType, "")
+		if err != nil {
+			return err
 		}
-		var condition string
-		switch fieldType.class {
-		case fieldTypeClassList, fieldTypeClassMap:
-			condition = fieldName + ".is_empty"
-		case fieldTypeClassObject:
-			if g.options.CoreObjects {
-				if fieldType.t.Name() == coreDurationMessage {
-					condition = fmt.Sprintf("%s.is_zero", fieldName)
-				} else if fieldType.t.Name() == coreTimestampMessage {
-					condition = fmt.Sprintf("(_protobuf.time_is_zero_epoch %s)", fieldName)
-				}
-			}
+		terms = append(terms, func() error {
+			return w.ConditionExpression(condition, "0", "1")
+		})
+	}
+	if extendee != "" {
+		terms = append(terms, func() error {
+			return g.writeNumExtensions(w)
+		})
+	}
+	if g.options.UnknownFields {
+		terms = append(terms, func() error {
+			return g.writeNumUnknownFields(w)
+		})
+	}
+	return writeSum(w, terms)
+}
 
-			if len(condition) == 0 {
-				condition = fieldName + ".is_empty"
-			}
-		case fieldTypeClassPrimitive:
-			if fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_STRING ||
-				fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_BYTES {
-				condition = fieldName + ".is_empty"
-			} else {
-				defaultValue, err := fieldType.DefaultValue()
-				if err != nil {
-					return err
-				}
-				condition = fieldName + " == " + defaultValue
-			}
-		}
+// isDefaultCondition returns the condition that holds when a field that is not
+// part of a oneof is unset. The receiver is prepended to the members that are
+// accessed.
+func (g *generator) isDefaultCondition(fieldType *fieldType, receiver string) (string, error) {
+	fieldName := uniqueName(fieldType.field.GetName(), reservedFieldNames, "_")
+	if fieldType.presence != nil {
+		return "not " + receiver + "has_" + fieldName, nil
+	}
+	if g.options.ConvertHooks {
+		fieldName = "_serialize_" + fieldName
+	}
+	fieldName = receiver + fieldName
 
-		if i != 0 {
-			w.Literal("+ ")
+	switch fieldType.class {
+	case fieldTypeClassList, fieldTypeClassMap:
+		return fieldName + ".is_empty", nil
+	case fieldTypeClassObject:
+		if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+			return coreObject.isDefaultCondition(fieldName), nil
 		}
-		w.ConditionExpression(condition, "0", "1")
-		w.EndLine()
-		i++
+		return fieldName + ".is_empty", nil
+	case fieldTypeClassPrimitive:
+		hasCustomDefault, err := fieldType.HasCustomDefault()
+		if err != nil {
+			return "", err
+		}
+		if !hasCustomDefault && (fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_STRING ||
+			fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_BYTES) {
+			return fieldName + ".is_empty", nil
+		}
+		defaultValue, err := fieldType.DefaultValue()
+		if err != nil {
+			return "", err
+		}
+		return defaultComparison(fieldName, defaultValue, true), nil
+	default:
+		return "", fmt.Errorf("unkonwn fieldType: %v for field: %s", fieldType.class, fieldType.field.GetName())
 	}
-	w.ReturnEnd()
-	w.EndFunction()
-	return nil
 }
 
-func (g *generator) writeProtobufSizeMethod(w *toit.Writer, fields []*fieldType, oneofTypes []*oneofType) error {
+func (g *generator) writeProtobufSizeMethod(w *toit.Writer, extendee string, fields []*fieldType, oneofTypes []*oneofType) error {
 	w.StartFunctionDecl("protobuf_size")
 	w.EndFunctionDecl("int")
 
-	if len(fields) == 0 {
-		return util.FirstError(
-			w.ReturnStart(),
-			w.Argument("0"),
-			w.ReturnEnd(),
-			w.EndFunction(),
-		)
-	}
-	w.ReturnStart()
-	w.Argument("")
-	for i, fieldType := range fields {
-		if i != 0 {
-			w.EndLine()
-			w.Literal("+ ")
-		}
+	var terms []func() error
+	for _, fieldType := range fields {
+		fieldType := fieldType
 
-		if fieldType.field.OneofIndex != nil {
+		var condition string
+		if fieldType.IsOneof() {
 			oneof := oneofTypes[*fieldType.field.OneofIndex]
 			fieldConstant := strings.ToUpper(oneof.CaseFields[fieldType.field.GetNumber()])
-			if err := util.FirstError(
+			condition = oneof.CaseName + " == " + fieldConstant
+		} else {
+			var err error
+			if condition, err = g.serializeCondition(fieldType, ""); err != nil {
+				return err
+			}
+		}
+
+		if condition == "" {
+			terms = append(terms, func() error {
+				return g.writeProtobufSizeField(w, fieldType, oneofTypes)
+			})
+			continue
+		}
+		terms = append(terms, func() error {
+			return util.FirstError(
 				w.StartParens(),
-				w.Literal(oneof.CaseName+" == "+fieldConstant),
+				w.Literal(condition),
 				w.Literal(" ? "),
 				g.writeProtobufSizeField(w, fieldType, oneofTypes),
 				w.Literal(" : "),
 				w.Literal("0"),
 				w.EndParens(),
-			); err != nil {
-				return err
-			}
-		} else {
-			if err := g.writeProtobufSizeField(w, fieldType, oneofTypes); err != nil {
-				return err
-			}
-		}
-		w.EndLine()
+			)
+		})
 	}
-	w.ReturnEnd()
-	w.EndFunction()
-	return nil
+	if extendee != "" {
+		terms = append(terms, func() error {
+			return g.writeProtobufSizeExtensions(w)
+		})
+	}
+	if g.options.UnknownFields {
+		terms = append(terms, func() error {
+			return g.writeProtobufSizeUnknownFields(w)
+		})
+	}
+	return writeSum(w, terms)
 }
 
 func (g *generator) writeProtobufSizeField(w *toit.Writer, fieldType *fieldType, oneofTypes []*oneofType) error {
@@ -1162,6 +1565,7 @@ func (g *generator) writeProtobufSizeField(w *toit.Writer, fieldType *fieldType,
 			w.Argument("_protobuf."+protoType),
 			w.Argument(fieldName),
 			w.NamedArgument("--as_field", strconv.Itoa(int(fieldType.field.GetNumber()))),
+			g.writePackedArgument(w, fieldType.field),
 			w.EndParens(),
 			w.EndCall(false),
 		); err != nil {
@@ -1189,37 +1593,25 @@ func (g *generator) writeProtobufSizeField(w *toit.Writer, fieldType *fieldType,
 			return err
 		}
 	case fieldTypeClassObject:
-		if g.options.CoreObjects {
-			if fieldType.t.Name() == coreDurationMessage {
-				if err := util.FirstError(
-					w.StartParens(),
-					w.StartCall("_protobuf.size_duration"),
-					w.Argument(fieldName),
-					w.NamedArgument("--as_field", strconv.Itoa(int(fieldType.field.GetNumber()))),
-					w.EndParens(),
-					w.EndCall(false),
-				); err != nil {
-					return err
-				}
-				return nil
-			} else if fieldType.t.Name() == coreTimestampMessage {
-				if err := util.FirstError(
-					w.StartParens(),
-					w.StartCall("_protobuf.size_timestamp"),
-					w.Argument(fieldName),
-					w.NamedArgument("--as_field", strconv.Itoa(int(fieldType.field.GetNumber()))),
-					w.EndParens(),
-					w.EndCall(false),
-				); err != nil {
-					return err
-				}
-				return nil
-			}
+		if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+			return util.FirstError(
+				w.StartParens(),
+				w.StartCall(coreObject.Size),
+				writeArguments(w, coreObject.Arguments),
+				w.Argument(fieldName),
+				w.NamedArgument("--as_field", strconv.Itoa(int(fieldType.field.GetNumber()))),
+				w.EndParens(),
+				w.EndCall(false),
+			)
 		}
 
+		size := "_protobuf.size_embedded_message"
+		if fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_GROUP {
+			size = "_protobuf.size_group"
+		}
 		if err := util.FirstError(
 			w.StartParens(),
-			w.StartCall("_protobuf.size_embedded_message"),
+			w.StartCall(size),
 			w.Argument("("+fieldName+".protobuf_size)"),
 			w.NamedArgument("--as_field", strconv.Itoa(int(fieldType.field.GetNumber()))),
 			w.EndParens(),
@@ -1249,8 +1641,12 @@ func (g *generator) writeProtobufSizeField(w *toit.Writer, fieldType *fieldType,
 }
 
 func (g *generator) resolveFieldType(field *descriptor.FieldDescriptorProto, ignoreRepeated bool) (*fieldType, error) {
+	if field.GetType() == descriptor.FieldDescriptorProto_TYPE_GROUP && !g.options.Groups {
+		return nil, fmt.Errorf("group field '%s' needs the '%s' option", field.GetName(), groupsParam)
+	}
+
 	var t *referType
-	if field.GetType() == descriptor.FieldDescriptorProto_TYPE_MESSAGE || field.GetType() == descriptor.FieldDescriptorProto_TYPE_ENUM {
+	if isMessageType(field.GetType()) || field.GetType() == descriptor.FieldDescriptorProto_TYPE_ENUM {
 		var ok bool
 		if t, ok = g.lookupType(field.GetTypeName()); !ok {
 			return nil, fmt.Errorf("failed to find fieldtype: %v for field: %s", field.GetTypeName(), field.GetName())
@@ -1265,7 +1661,7 @@ func (g *generator) resolveFieldType(field *descriptor.FieldDescriptorProto, ign
 	switch label {
 	case descriptor.FieldDescriptorProto_LABEL_OPTIONAL, descriptor.FieldDescriptorProto_LABEL_REQUIRED:
 		class := fieldTypeClassPrimitive
-		if field.GetType() == descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+		if isMessageType(field.GetType()) {
 			class = fieldTypeClassObject
 		}
 		return &fieldType{
@@ -1275,7 +1671,7 @@ func (g *generator) resolveFieldType(field *descriptor.FieldDescriptorProto, ign
 			t:     t,
 		}, nil
 	case descriptor.FieldDescriptorProto_LABEL_REPEATED:
-		if field.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE ||
+		if !isMessageType(field.GetType()) ||
 			(t.msg != nil && !t.msg.GetOptions().GetMapEntry()) {
 			valueField, err := g.resolveFieldType(field, true)
 			if err != nil {
@@ -1322,6 +1718,7 @@ func (g *generator) resolveFieldType(field *descriptor.FieldDescriptorProto, ign
 func (g *generator) Generate() (*plugin.CodeGeneratorResponse, error) {
 	g.resolveTypes()
 	res := &plugin.CodeGeneratorResponse{}
+	res.XXX_unrecognized = encodeVarintField(supportedFeaturesFieldNumber, featureProto3Optional)
 	files := util.NewStringSet(g.req.GetFileToGenerate()...)
 	// This convenience method will return a structure of some types that I use
 	for _, file := range g.req.ProtoFile {
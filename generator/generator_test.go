@@ -0,0 +1,34 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+func TestReservedFieldNames(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"name", "name"},
+		{"class", "_class"},
+		{"validate_field_mask", "_validate_field_mask"},
+		{"merge_masked", "_merge_masked"},
+		{"copy", "_copy"},
+		{"merge_from", "_merge_from"},
+		{"is_initialized", "_is_initialized"},
+		{"check_initialized", "_check_initialized"},
+	}
+	for _, test := range tests {
+		f := &fieldType{field: &descriptor.FieldDescriptorProto{Name: proto.String(test.name)}}
+		if have := f.FieldName(nil); have != test.want {
+			t.Errorf("%s: have %q, want %q", test.name, have, test.want)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+// jsonHelperNames are the members every message gets for the proto3 JSON
+// mapping.
+var jsonHelperNames = []string{"to_json", "from_json"}
+
+// enumTable returns the name of a generated table of the given enum.
+func (g *generator) enumTable(t *referType, table string) (string, error) {
+	importAlias, ok := g.imports[t.file.GetName()]
+	if !ok {
+		return "", fmt.Errorf("failed to find import alias for file: '%s' - object: '%s'", t.file.GetName(), t.Name())
+	}
+	return t.ToitType(importAlias) + "." + table, nil
+}
+
+// writeEnumTables writes the static tables of the enum class that map the
+// numbers of an enum to their names and back, and the set of numbers the enum
+// defines. Aliases share a number, so the first name is used for it.
+func (g *generator) writeEnumTables(w *toit.Writer, enum *descriptor.EnumDescriptorProto) error {
+	var names, numbers, known []string
+	seen := map[int32]bool{}
+	for _, value := range enum.GetValue() {
+		number := strconv.Itoa(int(value.GetNumber()))
+		numbers = append(numbers, `"`+value.GetName()+`": `+number)
+		if seen[value.GetNumber()] {
+			continue
+		}
+		seen[value.GetNumber()] = true
+		names = append(names, number+`: "`+value.GetName()+`"`)
+		known = append(known, number)
+	}
+	return util.FirstError(
+		w.StaticConst("NAMES", "Map", mapLiteral(names)),
+		w.StaticConst("NUMBERS", "Map", mapLiteral(numbers)),
+		w.StaticConst("KNOWN_VALUES", "Set", setLiteral(known)),
+	)
+}
+
+func mapLiteral(entries []string) string {
+	if len(entries) == 0 {
+		return "{:}"
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+func setLiteral(elements []string) string {
+	return "{" + strings.Join(elements, ", ") + "}"
+}
+
+// jsonName returns the key of a field in the JSON mapping.
+func jsonName(field *descriptor.FieldDescriptorProto) string {
+	if field.JsonName != nil {
+		return field.GetJsonName()
+	}
+	return toit.ToCamelCase(field.GetName())
+}
+
+// jsonKeys returns the keys that are accepted for a field in the JSON mapping.
+func jsonKeys(field *descriptor.FieldDescriptorProto) []string {
+	if jsonName(field) == field.GetName() {
+		return []string{field.GetName()}
+	}
+	return []string{jsonName(field), field.GetName()}
+}
+
+// keepsJSONNull returns true if a JSON null is a value of the field instead
+// of marking it as unset, which is the case for fields of type
+// google.protobuf.Value.
+func (g *generator) keepsJSONNull(fieldType *fieldType) bool {
+	if fieldType.class != fieldTypeClassObject || fieldType.t.Name() != coreValueMessage {
+		return false
+	}
+	_, ok := g.coreObjectType(fieldType.t)
+	return ok
+}
+
+// isSetCondition returns the condition that holds when a field is not at its
+// default value, or is set for fields with presence. The receiver is
+// prepended to the members that are accessed.
+func (g *generator) isSetCondition(fieldType *fieldType, oneofTypes []*oneofType, receiver string) (string, error) {
+	if fieldType.IsOneof() {
+		oneof := oneofTypes[fieldType.field.GetOneofIndex()]
+		return receiver + oneof.CaseName + " == " + strings.ToUpper(oneof.CaseFields[fieldType.field.GetNumber()]), nil
+	}
+	condition, err := g.serializeCondition(fieldType, receiver)
+	if err != nil || condition != "" {
+		return condition, err
+	}
+	condition, err = g.isDefaultCondition(fieldType, receiver)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(condition, " ") && !strings.HasPrefix(condition, "(") {
+		condition = "(" + condition + ")"
+	}
+	return "not " + condition, nil
+}
+
+// toJSONExpression converts a value of the given field type to its JSON
+// representation.
+func (g *generator) toJSONExpression(fieldType *fieldType, value string) (string, error) {
+	switch fieldType.class {
+	case fieldTypeClassList:
+		elem, err := g.toJSONExpression(fieldType.valueType, "it")
+		if err != nil {
+			return "", err
+		}
+		return value + ".map: " + elem, nil
+	case fieldTypeClassMap:
+		elem, err := g.toJSONExpression(fieldType.valueType, "it")
+		if err != nil {
+			return "", err
+		}
+		return "_protobuf.map_to_json " + value + ": " + elem, nil
+	case fieldTypeClassObject:
+		if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+			return strings.Join(append(append([]string{coreObject.ToJSON}, coreObject.Arguments...), value), " "), nil
+		}
+		return value + ".to_json", nil
+	case fieldTypeClassPrimitive:
+		if fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_ENUM {
+			names, err := g.enumTable(fieldType.t, "NAMES")
+			if err != nil {
+				return "", err
+			}
+			return "_protobuf.enum_to_json " + value + " " + names, nil
+		}
+		protoType, err := protobufTypeConst(fieldType.field.GetType())
+		if err != nil {
+			return "", err
+		}
+		return "_protobuf.primitive_to_json _protobuf." + protoType + " " + value, nil
+	default:
+		return "", fmt.Errorf("unkonwn fieldType: %v for field: %s", fieldType.class, fieldType.field.GetName())
+	}
+}
+
+// fromJSONExpression converts a JSON value to a value of the given field type.
+func (g *generator) fromJSONExpression(fieldType *fieldType, value string) (string, error) {
+	switch fieldType.class {
+	case fieldTypeClassList:
+		elem, err := g.fromJSONExpression(fieldType.valueType, "it")
+		if err != nil {
+			return "", err
+		}
+		return value + ".map: " + elem, nil
+	case fieldTypeClassMap:
+		keyType, err := protobufTypeConst(fieldType.keyType.field.GetType())
+		if err != nil {
+			return "", err
+		}
+		elem, err := g.fromJSONExpression(fieldType.valueType, "it")
+		if err != nil {
+			return "", err
+		}
+		return "_protobuf.map_from_json " + value + " _protobuf." + keyType + ": " + elem, nil
+	case fieldTypeClassObject:
+		if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+			return strings.Join(append(append([]string{coreObject.FromJSON}, coreObject.Arguments...), value), " "), nil
+		}
+		importAlias, ok := g.imports[fieldType.t.file.GetName()]
+		if !ok {
+			return "", fmt.Errorf("failed to find import alias for field: '%s' - field: '%s'", fieldType.t.file.GetName(), fieldType.t.Name())
+		}
+		expression := fieldType.t.ToitType(importAlias) + ".from_json " + value
+		if g.checksRequiredFields(fieldType.t) {
+			expression += " --no-check_initialized"
+		}
+		return expression, nil
+	case fieldTypeClassPrimitive:
+		if fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_ENUM {
+			numbers, err := g.enumTable(fieldType.t, "NUMBERS")
+			if err != nil {
+				return "", err
+			}
+			return "_protobuf.enum_from_json " + value + " " + numbers, nil
+		}
+		protoType, err := protobufTypeConst(fieldType.field.GetType())
+		if err != nil {
+			return "", err
+		}
+		return "_protobuf.primitive_from_json _protobuf." + protoType + " " + value, nil
+	default:
+		return "", fmt.Errorf("unkonwn fieldType: %v for field: %s", fieldType.class, fieldType.field.GetName())
+	}
+}
+
+// writeToJSONMethod writes a method that returns the message as a map that
+// follows the proto3 JSON mapping and can be encoded with encoding.json.
+// Fields with default values are left out.
+func (g *generator) writeToJSONMethod(w *toit.Writer, fields []*fieldType, oneofTypes []*oneofType) error {
+	if !g.options.JSON {
+		return nil
+	}
+	fieldNames := util.NewStringSet()
+	for _, fieldType := range fields {
+		fieldNames.Add(fieldType.FieldName(oneofTypes))
+	}
+	result := uniqueName("result", fieldNames, "_")
+
+	if err := util.FirstError(
+		w.StartFunctionDecl("to_json"),
+		w.EndFunctionDecl("Map"),
+		w.Variable(result, "", "{:}"),
+	); err != nil {
+		return err
+	}
+
+	for _, fieldType := range fields {
+		condition, err := g.isSetCondition(fieldType, oneofTypes, "")
+		if err != nil {
+			return err
+		}
+		value := g.getSerializeFieldName(fieldType.FieldName(oneofTypes), nil, nil)
+		expression, err := g.toJSONExpression(fieldType, value)
+		if err != nil {
+			return err
+		}
+		if err := util.FirstError(
+			w.StartCall("if"),
+			w.Argument(condition),
+			w.StartBlock(false),
+			w.StartAssignment(result+`["`+jsonName(fieldType.field)+`"]`),
+			w.Argument(expression),
+			w.EndAssignment(),
+			w.EndBlock(false),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		w.ReturnStart(),
+		w.Argument(result),
+		w.ReturnEnd(),
+		w.EndFunction(),
+	)
+}
+
+// writeFromJSONConstructor writes a constructor that reads the map produced by
+// decoding proto3 JSON. Both the JSON name and the original name of a field
+// are accepted, and unknown keys are ignored. Like deserialize, it checks the
+// required fields unless it is called for a nested message.
+func (g *generator) writeFromJSONConstructor(w *toit.Writer, checkRequired bool, fields []*fieldType, oneofTypes []*oneofType) error {
+	if !g.options.JSON {
+		return nil
+	}
+	if err := util.FirstError(
+		w.StartConstructorDecl("from_json"),
+		w.Parameter("json", "Map"),
+		writeCheckInitializedParameter(w, checkRequired),
+		w.EndConstructorDecl(),
+	); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return w.EndConstructor()
+	}
+
+	// A null value means the field is unset, except for Value fields, where
+	// null is a value of its own.
+	skipNull := "value == null"
+	for _, fieldType := range fields {
+		if !g.keepsJSONNull(fieldType) {
+			continue
+		}
+		for _, key := range jsonKeys(fieldType.field) {
+			skipNull += ` and key != "` + key + `"`
+		}
+	}
+
+	if err := util.FirstError(
+		w.StartCall("json.do"),
+		w.StartBlock(false, "key/string", "value"),
+		w.StartCall("if"),
+		w.Argument(skipNull),
+		w.StartBlock(false),
+		w.Literal("continue.do"),
+		w.EndLine(),
+		w.EndBlock(false),
+		w.EndCall(true),
+	); err != nil {
+		return err
+	}
+
+	for i, fieldType := range fields {
+		var conditions []string
+		for _, key := range jsonKeys(fieldType.field) {
+			conditions = append(conditions, `key == "`+key+`"`)
+		}
+		condition := strings.Join(conditions, " or ")
+		expression, err := g.fromJSONExpression(fieldType, "value")
+		if err != nil {
+			return err
+		}
+		if err := util.FirstError(
+			w.StartCall(ifElse(i)),
+			w.Argument(condition),
+			w.StartBlock(false),
+			g.writeFieldAssignment(w, fieldType, oneofTypes, expression),
+			w.EndBlock(false),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		w.EndBlock(false),
+		w.EndCall(true),
+		writeCheckInitialized(w, checkRequired, "this"),
+		w.EndConstructor(),
+	)
+}
+
+func (g *generator) writeFieldAssignment(w *toit.Writer, fieldType *fieldType, oneofTypes []*oneofType, expression string) error {
+	fieldName := fieldType.FieldName(oneofTypes)
+	if g.options.ConvertHooks && fieldType.class != fieldTypeClassObject {
+		return util.FirstError(
+			w.StartCall("this._deserialize_"+fieldName),
+			w.Argument("("+expression+")"),
+			w.EndCall(true),
+		)
+	}
+	return util.FirstError(
+		w.StartAssignment("this."+fieldName),
+		w.Argument(expression),
+		w.EndAssignment(),
+	)
+}
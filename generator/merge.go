@@ -0,0 +1,200 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+// mergeHelperNames are the members every message gets for copying and
+// merging.
+var mergeHelperNames = []string{"copy", "merge_from"}
+
+// copyExpression returns a deep copy of a value of the given field type.
+// Immutable values are returned as they are.
+func (g *generator) copyExpression(fieldType *fieldType, value string) string {
+	switch fieldType.class {
+	case fieldTypeClassList:
+		element := g.copyExpression(fieldType.valueType, "it")
+		if element == "it" {
+			return value + ".copy"
+		}
+		return value + ".map: " + element
+	case fieldTypeClassMap:
+		element := g.copyExpression(fieldType.valueType, "element")
+		if element == "element" {
+			return value + ".copy"
+		}
+		return value + ".map: | key element | " + element
+	case fieldTypeClassObject:
+		if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+			if coreObject.Copy == "" {
+				return value
+			}
+			return coreObject.Copy + " " + value
+		}
+		return value + ".copy"
+	default:
+		if fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_BYTES {
+			return value + ".copy"
+		}
+		return value
+	}
+}
+
+// mergeCall returns the call that merges a set value into an existing one,
+// or "" if a set value replaces the existing one.
+func (g *generator) mergeCall(fieldType *fieldType, target string, source string) string {
+	if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+		if coreObject.Merge == "" {
+			return ""
+		}
+		return coreObject.Merge + " " + target + " " + source
+	}
+	return target + ".merge_from " + source
+}
+
+func (g *generator) writeCopyMethod(w *toit.Writer, className string) error {
+	return util.FirstError(
+		w.StartFunctionDecl("copy"),
+		w.EndFunctionDecl(className),
+		w.Variable("result", "", className),
+		w.StartCall("result.merge_from"),
+		w.Argument("this"),
+		w.EndCall(true),
+		w.ReturnStart(),
+		w.Argument("result"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+	)
+}
+
+// writeMergeFromMethod writes a method that merges another instance into this
+// one. Set scalars overwrite, repeated fields are appended, maps are merged
+// entry by entry, and messages are merged recursively. Values taken from the
+// other instance are copied.
+func (g *generator) writeMergeFromMethod(w *toit.Writer, className string, extendee string, fields []*fieldType, oneofTypes []*oneofType) error {
+	if err := util.FirstError(
+		w.StartFunctionDecl("merge_from"),
+		w.Parameter("other", className),
+		w.EndFunctionDecl("none"),
+	); err != nil {
+		return err
+	}
+
+	for _, fieldType := range fields {
+		if err := g.writeMergeField(w, fieldType, oneofTypes); err != nil {
+			return err
+		}
+	}
+
+	if extendee != "" {
+		if err := g.writeMergeExtensions(w); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		g.writeMergeUnknownFields(w),
+		w.EndFunction(),
+	)
+}
+
+func (g *generator) writeMergeField(w *toit.Writer, fieldType *fieldType, oneofTypes []*oneofType) error {
+	fieldName := fieldType.FieldName(oneofTypes)
+	target := "this." + fieldName
+	source := "other." + fieldName
+
+	switch fieldType.class {
+	case fieldTypeClassList:
+		element := g.copyExpression(fieldType.valueType, "it")
+		if element == "it" {
+			return util.FirstError(
+				w.StartCall(target+".add_all"),
+				w.Argument(source),
+				w.EndCall(true),
+			)
+		}
+		return util.FirstError(
+			w.StartCall(source+".do"),
+			w.StartBlock(false),
+			w.StartCall(target+".add"),
+			w.Argument("("+element+")"),
+			w.EndCall(true),
+			w.EndBlock(false),
+			w.EndCall(true),
+		)
+	case fieldTypeClassMap:
+		return util.FirstError(
+			w.StartCall(source+".do"),
+			w.StartBlock(false, "key", "value"),
+			w.StartAssignment(target+"[key]"),
+			w.Argument(g.copyExpression(fieldType.valueType, "value")),
+			w.EndAssignment(),
+			w.EndBlock(false),
+			w.EndCall(true),
+		)
+	}
+
+	isSet, err := g.isSetCondition(fieldType, oneofTypes, "other.")
+	if err != nil {
+		return err
+	}
+	if err := util.FirstError(
+		w.StartCall("if"),
+		w.Argument(isSet),
+		w.StartBlock(false),
+	); err != nil {
+		return err
+	}
+
+	merge := ""
+	if fieldType.class == fieldTypeClassObject {
+		merge = g.mergeCall(fieldType, target, source)
+	}
+	if merge != "" {
+		isSetHere, err := g.isSetCondition(fieldType, oneofTypes, "this.")
+		if err != nil {
+			return err
+		}
+		if err := util.FirstError(
+			w.StartCall("if"),
+			w.Argument(isSetHere),
+			w.StartBlock(false),
+			w.Literal(merge),
+			w.EndLine(),
+			w.EndBlock(false),
+			w.EndCall(true),
+			w.StartCall("else"),
+			w.StartBlock(false),
+		); err != nil {
+			return err
+		}
+	}
+
+	if err := util.FirstError(
+		w.StartAssignment(target),
+		w.Argument(g.copyExpression(fieldType, source)),
+		w.EndAssignment(),
+	); err != nil {
+		return err
+	}
+
+	if merge != "" {
+		if err := util.FirstError(
+			w.EndBlock(false),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
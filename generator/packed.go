@@ -0,0 +1,51 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+)
+
+// isPackable returns true if the repeated field can use the packed encoding,
+// which is the case for all scalar types except strings and bytes.
+func isPackable(field *descriptor.FieldDescriptorProto) bool {
+	switch field.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_STRING,
+		descriptor.FieldDescriptorProto_TYPE_BYTES,
+		descriptor.FieldDescriptorProto_TYPE_MESSAGE,
+		descriptor.FieldDescriptorProto_TYPE_GROUP:
+		return false
+	default:
+		return true
+	}
+}
+
+// isPacked returns true if the repeated field is written with the packed
+// encoding. Proto3 fields are packed unless they are marked [packed=false],
+// proto2 fields only if they are marked [packed=true]. Readers accept both
+// encodings.
+func (g *generator) isPacked(field *descriptor.FieldDescriptorProto) bool {
+	if !isPackable(field) {
+		return false
+	}
+	if field.GetOptions() != nil && field.GetOptions().Packed != nil {
+		return field.GetOptions().GetPacked()
+	}
+	return !isProto2(g.file)
+}
+
+// writePackedArgument tells the runtime which encoding to use for a repeated
+// field of a packable type. Without the packed option the runtime picks the
+// encoding.
+func (g *generator) writePackedArgument(w *toit.Writer, field *descriptor.FieldDescriptorProto) error {
+	if !g.options.Packed || !isPackable(field) {
+		return nil
+	}
+	if g.isPacked(field) {
+		return w.NamedArgument("--packed", "")
+	}
+	return w.NamedArgument("--no-packed", "")
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+)
+
+func TestIsPacked(t *testing.T) {
+	tests := []struct {
+		syntax string
+		typ    descriptor.FieldDescriptorProto_Type
+		packed *bool
+		want   bool
+	}{
+		{"proto3", descriptor.FieldDescriptorProto_TYPE_INT32, nil, true},
+		{"proto3", descriptor.FieldDescriptorProto_TYPE_ENUM, nil, true},
+		{"proto3", descriptor.FieldDescriptorProto_TYPE_DOUBLE, proto.Bool(false), false},
+		{"proto3", descriptor.FieldDescriptorProto_TYPE_STRING, nil, false},
+		{"proto3", descriptor.FieldDescriptorProto_TYPE_MESSAGE, nil, false},
+		{"proto2", descriptor.FieldDescriptorProto_TYPE_INT32, nil, false},
+		{"proto2", descriptor.FieldDescriptorProto_TYPE_FIXED64, proto.Bool(true), true},
+		{"proto2", descriptor.FieldDescriptorProto_TYPE_BYTES, proto.Bool(true), false},
+		{"", descriptor.FieldDescriptorProto_TYPE_BOOL, nil, false},
+	}
+	for _, test := range tests {
+		g := &generator{file: &descriptor.FileDescriptorProto{Syntax: proto.String(test.syntax)}}
+		field := &descriptor.FieldDescriptorProto{Type: test.typ.Enum()}
+		if test.packed != nil {
+			field.Options = &descriptor.FieldOptions{Packed: test.packed}
+		}
+		if have := g.isPacked(field); have != test.want {
+			t.Errorf("syntax=%q type=%v packed=%v: have %v, want %v", test.syntax, test.typ, test.packed, have, test.want)
+		}
+	}
+}
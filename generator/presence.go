@@ -0,0 +1,228 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"strconv"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+const (
+	// proto3OptionalFieldNumber is the number of FieldDescriptorProto.proto3_optional,
+	// which is newer than the descriptors we are compiled against.
+	proto3OptionalFieldNumber = 17
+	// supportedFeaturesFieldNumber is the number of CodeGeneratorResponse.supported_features.
+	supportedFeaturesFieldNumber = 2
+	// featureProto3Optional is CodeGeneratorResponse.FEATURE_PROTO3_OPTIONAL.
+	featureProto3Optional = 1
+
+	// presenceBitsPerWord keeps the presence words small integers on 32 bit devices.
+	presenceBitsPerWord = 30
+)
+
+type presenceType struct {
+	Word string
+	Mask string
+}
+
+func newPresenceType(index int) *presenceType {
+	return &presenceType{
+		Word: presenceWordName(index / presenceBitsPerWord),
+		Mask: strconv.Itoa(1 << uint(index%presenceBitsPerWord)),
+	}
+}
+
+func presenceWordName(i int) string {
+	return "presence_" + strconv.Itoa(i) + "_"
+}
+
+func isProto3Optional(field *descriptor.FieldDescriptorProto) bool {
+	v, ok := unrecognizedVarint(field.XXX_unrecognized, proto3OptionalFieldNumber)
+	return ok && v != 0
+}
+
+// isSyntheticOneof returns true if the oneof at the given index was generated
+// by protoc to track the presence of a proto3 optional field.
+func isSyntheticOneof(msg *descriptor.DescriptorProto, index int) bool {
+	for _, field := range msg.GetField() {
+		if field.OneofIndex != nil && int(field.GetOneofIndex()) == index {
+			return isProto3Optional(field)
+		}
+	}
+	return false
+}
+
+func isProto2(file *descriptor.FileDescriptorProto) bool {
+	return file.GetSyntax() == "" || file.GetSyntax() == "proto2"
+}
+
+// hasPresence returns true if the field tracks whether it has been set
+// separately from its value.
+func (g *generator) hasPresence(fieldType *fieldType) bool {
+	switch fieldType.class {
+	case fieldTypeClassObject:
+		// Fields mapped to nullable types are unset when they are null.
+		return !g.isNullableCoreObject(fieldType)
+	case fieldTypeClassPrimitive:
+		if isProto3Optional(fieldType.field) {
+			return true
+		}
+		return isProto2(g.file) && fieldType.field.GetLabel() != descriptor.FieldDescriptorProto_LABEL_REPEATED
+	default:
+		return false
+	}
+}
+
+// hasPresenceCondition returns the condition that holds when a field with
+// presence is set. Messages and containers that are modified in place
+// through the getter count as set as well.
+func (g *generator) hasPresenceCondition(fieldType *fieldType) string {
+	presence := fieldType.presence
+	condition := "(" + presence.Word + " & " + presence.Mask + ") != 0"
+	if fieldType.class != fieldTypeClassObject {
+		return condition
+	}
+
+	storage := uniqueName(fieldType.field.GetName(), reservedFieldNames, "_") + "_"
+	if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+		if coreObject.Mutable {
+			condition += " or not " + coreObject.isDefaultCondition(storage)
+		}
+	} else if fieldType.lazy {
+		condition += " or (" + storage + " != null and not " + storage + ".is_empty)"
+	} else {
+		condition += " or not " + storage + ".is_empty"
+	}
+	return condition
+}
+
+// unrecognizedVarint finds a varint field in the unrecognized bytes of a
+// message.
+func unrecognizedVarint(b []byte, fieldNumber uint64) (uint64, bool) {
+	buf := proto.NewBuffer(b)
+	for {
+		tag, err := buf.DecodeVarint()
+		if err != nil {
+			return 0, false
+		}
+		var v uint64
+		switch tag & 0x7 {
+		case proto.WireVarint:
+			v, err = buf.DecodeVarint()
+		case proto.WireFixed64:
+			v, err = buf.DecodeFixed64()
+		case proto.WireFixed32:
+			v, err = buf.DecodeFixed32()
+		case proto.WireBytes:
+			_, err = buf.DecodeRawBytes(false)
+		default:
+			return 0, false
+		}
+		if err != nil {
+			return 0, false
+		}
+		if tag>>3 == fieldNumber && tag&0x7 == proto.WireVarint {
+			return v, true
+		}
+	}
+}
+
+func encodeVarintField(fieldNumber uint64, v uint64) []byte {
+	return append(proto.EncodeVarint(fieldNumber<<3|proto.WireVarint), proto.EncodeVarint(v)...)
+}
+
+func (g *generator) writePresenceWords(w *toit.Writer, numPresenceFields int) error {
+	for i := 0; i*presenceBitsPerWord < numPresenceFields; i++ {
+		if err := w.Variable(presenceWordName(i), "int", "0"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *generator) writePresenceAccessors(w *toit.Writer, fieldType *fieldType) error {
+	fieldName := uniqueName(fieldType.field.GetName(), reservedFieldNames, "_")
+	storage := fieldName + "_"
+	presence := fieldType.presence
+
+	t, err := fieldType.ToitTypeAnnotation(false)
+	if err != nil {
+		return err
+	}
+	defaultValue, err := fieldType.DefaultValue()
+	if err != nil {
+		return err
+	}
+	if fieldType.lazy {
+		defaultValue = "null"
+	}
+
+	return util.FirstError(
+		// Getter
+		g.writeComment(w, fieldType.field),
+		w.StartFunctionDecl(fieldName),
+		w.EndFunctionDecl(t),
+		func() error {
+			if !fieldType.lazy {
+				return nil
+			}
+			return g.writeLazyInitialization(w, fieldType, storage)
+		}(),
+		w.ReturnStart(),
+		w.Argument(storage),
+		w.ReturnEnd(),
+		w.EndFunction(),
+
+		// Setter
+		w.StartFunctionDecl(fieldName+"="),
+		w.Parameter(fieldName, t),
+		w.EndFunctionDecl("none"),
+		w.StartAssignment(storage),
+		w.Argument(fieldName),
+		w.EndAssignment(),
+		w.Literal(presence.Word+" |= "+presence.Mask),
+		w.EndLine(),
+		w.EndFunction(),
+
+		w.StartFunctionDecl("has_"+fieldName),
+		w.EndFunctionDecl("bool"),
+		w.ReturnStart(),
+		w.Argument(g.hasPresenceCondition(fieldType)),
+		w.ReturnEnd(),
+		w.EndFunction(),
+
+		w.StartFunctionDecl("clear_"+fieldName),
+		w.EndFunctionDecl("none"),
+		w.StartAssignment(storage),
+		w.Argument(defaultValue),
+		w.EndAssignment(),
+		w.Literal(presence.Word+" &= ~"+presence.Mask),
+		w.EndLine(),
+		w.EndFunction(),
+	)
+}
+
+// writeLazyInitialization allocates the message of a lazy field the first
+// time it is accessed.
+func (g *generator) writeLazyInitialization(w *toit.Writer, fieldType *fieldType, storage string) error {
+	defaultValue, err := fieldType.DefaultValue()
+	if err != nil {
+		return err
+	}
+	return util.FirstError(
+		w.StartCall("if"),
+		w.Argument("not "+storage),
+		w.StartBlock(false),
+		w.StartAssignment(storage),
+		w.Argument(defaultValue),
+		w.EndAssignment(),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
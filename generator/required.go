@@ -0,0 +1,244 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+// requiredHelperNames are the members every message gets for checking
+// required fields.
+var requiredHelperNames = []string{"is_initialized", "check_initialized", "add_missing_fields_"}
+
+func isRequired(field *descriptor.FieldDescriptorProto) bool {
+	return field.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REQUIRED
+}
+
+// hasRequiredFields returns true if a message of the given type, or any
+// message nested in it, has required fields.
+func (g *generator) hasRequiredFields(t *referType, visited map[*referType]bool) bool {
+	if t == nil || t.msg == nil || visited[t] {
+		return false
+	}
+	visited[t] = true
+	for _, field := range t.msg.GetField() {
+		if isRequired(field) {
+			return true
+		}
+		if !isMessageType(field.GetType()) || g.isCoreMessage(field.GetTypeName()) {
+			continue
+		}
+		if fieldType, ok := g.lookupType(field.GetTypeName()); ok && g.hasRequiredFields(fieldType, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// checksRequiredFields returns true if messages of the given type check their
+// required fields when they are serialized and deserialized.
+func (g *generator) checksRequiredFields(t *referType) bool {
+	return g.hasRequiredFields(t, map[*referType]bool{})
+}
+
+func (g *generator) writeInitializedMethods(w *toit.Writer, typ *referType, fields []*fieldType, oneofTypes []*oneofType) error {
+	if !g.checksRequiredFields(typ) {
+		return util.FirstError(
+			w.StartFunctionDecl("is_initialized"),
+			w.EndFunctionDecl("bool"),
+			w.ReturnStart(),
+			w.Argument("true"),
+			w.ReturnEnd(),
+			w.EndFunction(),
+
+			w.StartFunctionDecl("check_initialized"),
+			w.EndFunctionDecl("none"),
+			w.Literal("return"),
+			w.EndLine(),
+			w.EndFunction(),
+		)
+	}
+
+	return util.FirstError(
+		w.StartFunctionDecl("is_initialized"),
+		w.EndFunctionDecl("bool"),
+		w.Variable("missing", "", "[]"),
+		w.StartCall("add_missing_fields_"),
+		w.Argument(`""`),
+		w.Argument("missing"),
+		w.EndCall(true),
+		w.ReturnStart(),
+		w.Argument("missing.is_empty"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+
+		w.StartFunctionDecl("check_initialized"),
+		w.EndFunctionDecl("none"),
+		w.Variable("missing", "", "[]"),
+		w.StartCall("add_missing_fields_"),
+		w.Argument(`""`),
+		w.Argument("missing"),
+		w.EndCall(true),
+		w.StartCall("if"),
+		w.Argument("not missing.is_empty"),
+		w.StartBlock(false),
+		w.Literal(`throw "MISSING_REQUIRED_FIELDS: $(missing.join ", ")"`),
+		w.EndLine(),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.EndFunction(),
+
+		g.writeAddMissingFieldsMethod(w, fields, oneofTypes),
+	)
+}
+
+// writeAddMissingFieldsMethod writes a method that adds the paths of all
+// required fields that are not set to a list, including the ones of nested
+// messages.
+func (g *generator) writeAddMissingFieldsMethod(w *toit.Writer, fields []*fieldType, oneofTypes []*oneofType) error {
+	fieldNames := util.NewStringSet()
+	for _, fieldType := range fields {
+		fieldNames.Add(fieldType.FieldName(oneofTypes))
+	}
+	prefix := uniqueName("prefix", fieldNames, "_")
+	missing := uniqueName("missing", fieldNames, "_")
+	index := uniqueName("i", fieldNames, "_")
+	key := uniqueName("key", fieldNames, "_")
+	value := uniqueName("value", fieldNames, "_")
+
+	if err := util.FirstError(
+		w.StartFunctionDecl("add_missing_fields_"),
+		w.Parameter(prefix, "string"),
+		w.Parameter(missing, "List"),
+		w.EndFunctionDecl("none"),
+	); err != nil {
+		return err
+	}
+
+	for _, fieldType := range fields {
+		fieldName := fieldType.FieldName(oneofTypes)
+		name := fieldType.field.GetName()
+
+		if isRequired(fieldType.field) {
+			if err := util.FirstError(
+				w.StartCall("if"),
+				w.Argument("not has_"+fieldName),
+				w.StartBlock(false),
+				w.StartCall(missing+".add"),
+				w.Argument(`"$(`+prefix+`)`+name+`"`),
+				w.EndCall(true),
+				w.EndBlock(false),
+				w.EndCall(true),
+			); err != nil {
+				return err
+			}
+		}
+
+		valueType := fieldType
+		if fieldType.class == fieldTypeClassList || fieldType.class == fieldTypeClassMap {
+			valueType = fieldType.valueType
+		}
+		if valueType.class != fieldTypeClassObject || g.isCoreObject(valueType) || !g.checksRequiredFields(valueType.t) {
+			continue
+		}
+
+		switch fieldType.class {
+		case fieldTypeClassList:
+			if err := util.FirstError(
+				w.StartCall(fieldName+".size.repeat"),
+				w.StartBlock(false, index),
+				w.StartCall(fieldName+"["+index+"].add_missing_fields_"),
+				w.Argument(`"$(`+prefix+`)`+name+`[$`+index+`]."`),
+				w.Argument(missing),
+				w.EndCall(true),
+				w.EndBlock(false),
+				w.EndCall(true),
+			); err != nil {
+				return err
+			}
+		case fieldTypeClassMap:
+			if err := util.FirstError(
+				w.StartCall(fieldName+".do"),
+				w.StartBlock(false, key, value),
+				w.StartCall(value+".add_missing_fields_"),
+				w.Argument(`"$(`+prefix+`)`+name+`[$`+key+`]."`),
+				w.Argument(missing),
+				w.EndCall(true),
+				w.EndBlock(false),
+				w.EndCall(true),
+			); err != nil {
+				return err
+			}
+		default:
+			if isRequired(fieldType.field) {
+				// Continues the check for the field itself above.
+				if err := w.StartCall("else"); err != nil {
+					return err
+				}
+			} else {
+				condition, err := g.isSetCondition(fieldType, oneofTypes, "")
+				if err != nil {
+					return err
+				}
+				if err := util.FirstError(
+					w.StartCall("if"),
+					w.Argument(condition),
+				); err != nil {
+					return err
+				}
+			}
+			if err := util.FirstError(
+				w.StartBlock(false),
+				w.StartCall(fieldName+".add_missing_fields_"),
+				w.Argument(`"$(`+prefix+`)`+name+`."`),
+				w.Argument(missing),
+				w.EndCall(true),
+				w.EndBlock(false),
+				w.EndCall(true),
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return w.EndFunction()
+}
+
+// writeNoCheckInitializedArgument skips the check of the required fields when
+// a nested message is serialized or deserialized, as the message that
+// contains it checks them for the whole tree.
+func (g *generator) writeNoCheckInitializedArgument(w *toit.Writer, fieldType *fieldType) error {
+	if !g.checksRequiredFields(fieldType.t) {
+		return nil
+	}
+	return w.NamedArgument("--no-check_initialized", "")
+}
+
+// writeCheckInitializedParameter adds the flag that selects whether the
+// required fields are checked, for messages that have any.
+func writeCheckInitializedParameter(w *toit.Writer, checkRequired bool) error {
+	if !checkRequired {
+		return nil
+	}
+	return w.ParameterWithDefault("--check_initialized", "bool", "true")
+}
+
+// writeCheckInitialized checks the required fields of the target if the flag
+// written by writeCheckInitializedParameter is set.
+func writeCheckInitialized(w *toit.Writer, checkRequired bool, target string) error {
+	if !checkRequired {
+		return nil
+	}
+	return util.FirstError(
+		w.StartCall("if"),
+		w.Argument("check_initialized"),
+		w.StartBlock(false),
+		w.StartCall(target+".check_initialized"),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
@@ -0,0 +1,506 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+type methodType struct {
+	Name       string
+	Constant   string
+	Path       string
+	InputType  string
+	OutputType string
+	Descriptor *descriptor.MethodDescriptorProto
+}
+
+func (m *methodType) ClientStreaming() bool {
+	return m.Descriptor.GetClientStreaming()
+}
+
+func (m *methodType) ServerStreaming() bool {
+	return m.Descriptor.GetServerStreaming()
+}
+
+// clientChannel returns the expression opening a channel that receives
+// response messages.
+func (m *methodType) clientChannel() string {
+	return "_protobuf.RpcChannel (transport_.open " + m.Constant + "):: " + m.OutputType + ".deserialize it"
+}
+
+// handlerChannel returns the expression wrapping an incoming stream in a
+// channel that receives request messages.
+func (m *methodType) handlerChannel() string {
+	return "_protobuf.RpcChannel stream:: " + m.InputType + ".deserialize it"
+}
+
+func (g *generator) resolveMethodTypes(file *descriptor.FileDescriptorProto, service *descriptor.ServiceDescriptorProto) ([]*methodType, error) {
+	servicePath := service.GetName()
+	if file.GetPackage() != "" {
+		servicePath = file.GetPackage() + "." + servicePath
+	}
+
+	definedNames := util.NewStringSet()
+	var res []*methodType
+	for _, method := range service.GetMethod() {
+		name := uniqueName(toit.ToSnakeCase(method.GetName()), reservedFieldNames, "_")
+		if definedNames.Contains(name) {
+			return nil, fmt.Errorf("name clash for method: %v in service: %s", name, service.GetName())
+		}
+		definedNames.Add(name)
+
+		inputType, err := g.methodMessageType(method.GetInputType())
+		if err != nil {
+			return nil, err
+		}
+		outputType, err := g.methodMessageType(method.GetOutputType())
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, &methodType{
+			Name:       name,
+			Constant:   toitClassName(strings.ToUpper(name), service.GetName()),
+			Path:       "/" + servicePath + "/" + method.GetName(),
+			InputType:  inputType,
+			OutputType: outputType,
+			Descriptor: method,
+		})
+	}
+	return res, nil
+}
+
+func (g *generator) methodMessageType(typ string) (string, error) {
+	t, ok := g.lookupType(typ)
+	if !ok || t.msg == nil {
+		return "", fmt.Errorf("failed to find message type: %v", typ)
+	}
+	importAlias, ok := g.imports[t.file.GetName()]
+	if !ok {
+		return "", fmt.Errorf("failed to find import alias for file: '%s' - object: '%s'", t.file.GetName(), t.Name())
+	}
+	return t.ToitType(importAlias), nil
+}
+
+// fileDefinedNames returns the top-level names defined by the messages, enums
+// and extensions of the file.
+func (g *generator) fileDefinedNames(file *descriptor.FileDescriptorProto, typePath ...string) (util.StringSet, error) {
+	definedNames := util.NewStringSet()
+	for _, t := range g.types {
+		if t.file != file {
+			continue
+		}
+		className := t.ToitType("")
+		definedNames.Add(className)
+		if t.enum != nil {
+			for _, value := range t.enum.GetValue() {
+				definedNames.Add(toitClassName(value.GetName(), className))
+			}
+		}
+	}
+	if g.options.Extensions {
+		extTypes, err := g.resolveExtensionTypes(file, typePath...)
+		if err != nil {
+			return nil, err
+		}
+		for _, ext := range extTypes {
+			definedNames.Add(ext.Constant)
+		}
+	}
+	return definedNames, nil
+}
+
+func (g *generator) writeService(w *toit.Writer, file *descriptor.FileDescriptorProto, service *descriptor.ServiceDescriptorProto, definedNames util.StringSet, typePath ...string) error {
+	typeName := typeName(service.GetName(), typePath...)
+	methods, err := g.resolveMethodTypes(file, service)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{service.GetName() + "Client", service.GetName() + "Handler"} {
+		if definedNames.Contains(name) {
+			return fmt.Errorf("name clash for service class: %v", name)
+		}
+		definedNames.Add(name)
+	}
+	for _, method := range methods {
+		if definedNames.Contains(method.Constant) {
+			return fmt.Errorf("name clash for method constant: %v", method.Constant)
+		}
+		definedNames.Add(method.Constant)
+	}
+
+	w.SingleLineComment("SERVICE START: " + typeName)
+	for _, method := range methods {
+		if err := w.Const(method.Constant, "string", `"`+method.Path+`"`); err != nil {
+			return err
+		}
+	}
+	w.NewLine()
+
+	if err := g.writeServiceClient(w, service, methods); err != nil {
+		return err
+	}
+
+	if err := g.writeServiceHandler(w, service, methods); err != nil {
+		return err
+	}
+
+	w.SingleLineComment("SERVICE END: " + typeName)
+	w.NewLine()
+	return nil
+}
+
+func (g *generator) writeServiceClient(w *toit.Writer, service *descriptor.ServiceDescriptorProto, methods []*methodType) error {
+	if err := util.FirstError(
+		g.writeComment(w, service),
+		w.StartClass(service.GetName()+"Client", ""),
+		w.Field("transport_", "_protobuf.RpcTransport"),
+		w.NewLine(),
+		w.StartConstructorDecl(""),
+		w.Argument(".transport_"),
+		w.EndConstructorDecl(),
+		w.EndConstructor(),
+	); err != nil {
+		return err
+	}
+
+	for _, method := range methods {
+		if err := g.writeComment(w, method.Descriptor); err != nil {
+			return err
+		}
+		var err error
+		switch {
+		case method.ClientStreaming() && method.ServerStreaming():
+			err = g.writeBidiStreamingClientMethod(w, method)
+		case method.ClientStreaming():
+			err = g.writeClientStreamingClientMethod(w, method)
+		case method.ServerStreaming():
+			err = g.writeServerStreamingClientMethod(w, method)
+		default:
+			err = g.writeUnaryClientMethod(w, method)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.EndClass()
+}
+
+func (g *generator) writeUnaryClientMethod(w *toit.Writer, method *methodType) error {
+	return util.FirstError(
+		w.StartFunctionDecl(method.Name),
+		w.Parameter("request", method.InputType),
+		w.EndFunctionDecl(method.OutputType),
+		w.Variable("w", "", "_protobuf.Writer"),
+		w.StartCall("request.serialize"),
+		w.Argument("w"),
+		w.EndCall(true),
+		w.Variable("response", "", "transport_.call "+method.Constant+" w.to_byte_array"),
+		w.ReturnStart(),
+		w.Argument(method.OutputType+".deserialize"),
+		w.Argument("(_protobuf.Reader response)"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+	)
+}
+
+func (g *generator) writeServerStreamingClientMethod(w *toit.Writer, method *methodType) error {
+	return util.FirstError(
+		w.StartFunctionDecl(method.Name),
+		w.Parameter("request", method.InputType),
+		w.Parameter("[block]", ""),
+		w.EndFunctionDecl("none"),
+		w.Variable("channel", "", method.clientChannel()),
+		writeTryFinally(w, func() error {
+			return util.FirstError(
+				w.StartCall("channel.send"),
+				w.Argument("request"),
+				w.EndCall(true),
+				w.StartCall("channel.close_send"),
+				w.EndCall(true),
+				w.StartCall("while"),
+				w.Argument("response := channel.receive"),
+				w.StartBlock(false),
+				w.StartCall("block.call"),
+				w.Argument("response"),
+				w.EndCall(true),
+				w.EndBlock(false),
+				w.EndCall(true),
+			)
+		}, writeChannelClose),
+		w.EndFunction(),
+	)
+}
+
+func (g *generator) writeClientStreamingClientMethod(w *toit.Writer, method *methodType) error {
+	return util.FirstError(
+		w.StartFunctionDecl(method.Name),
+		w.Parameter("[block]", ""),
+		w.EndFunctionDecl(method.OutputType),
+		w.Variable("channel", "", method.clientChannel()),
+		writeTryFinally(w, func() error {
+			return util.FirstError(
+				w.StartCall("block.call"),
+				w.Argument("channel"),
+				w.EndCall(true),
+				w.StartCall("channel.close_send"),
+				w.EndCall(true),
+				w.ReturnStart(),
+				w.Argument("channel.receive"),
+				w.ReturnEnd(),
+			)
+		}, writeChannelClose),
+		w.EndFunction(),
+	)
+}
+
+func (g *generator) writeBidiStreamingClientMethod(w *toit.Writer, method *methodType) error {
+	return util.FirstError(
+		w.StartFunctionDecl(method.Name),
+		w.Parameter("[block]", ""),
+		w.EndFunctionDecl("none"),
+		w.Variable("channel", "", method.clientChannel()),
+		writeTryFinally(w, func() error {
+			return util.FirstError(
+				w.StartCall("block.call"),
+				w.Argument("channel"),
+				w.EndCall(true),
+			)
+		}, writeChannelClose),
+		w.EndFunction(),
+	)
+}
+
+func writeChannelClose(w *toit.Writer) error {
+	return util.FirstError(
+		w.StartCall("channel.close"),
+		w.EndCall(true),
+	)
+}
+
+func writeTryFinally(w *toit.Writer, body func() error, finally func(w *toit.Writer) error) error {
+	return util.FirstError(
+		w.StartCall("try"),
+		w.StartBlock(false),
+		body(),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.StartCall("finally"),
+		w.StartBlock(false),
+		finally(w),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
+
+func (g *generator) writeServiceHandler(w *toit.Writer, service *descriptor.ServiceDescriptorProto, methods []*methodType) error {
+	if err := util.FirstError(
+		g.writeComment(w, service),
+		w.StartAbstractClass(service.GetName()+"Handler", ""),
+	); err != nil {
+		return err
+	}
+
+	var unaryMethods, streamingMethods []*methodType
+	for _, method := range methods {
+		if err := g.writeComment(w, method.Descriptor); err != nil {
+			return err
+		}
+		var err error
+		switch {
+		case method.ClientStreaming() && method.ServerStreaming():
+			err = util.FirstError(
+				w.StartAbstractFunctionDecl(method.Name),
+				w.Parameter("channel", "_protobuf.RpcChannel"),
+				w.EndAbstractFunctionDecl("none"),
+			)
+		case method.ClientStreaming():
+			err = util.FirstError(
+				w.StartAbstractFunctionDecl(method.Name),
+				w.Parameter("channel", "_protobuf.RpcChannel"),
+				w.EndAbstractFunctionDecl(method.OutputType),
+			)
+		case method.ServerStreaming():
+			err = util.FirstError(
+				w.StartAbstractFunctionDecl(method.Name),
+				w.Parameter("request", method.InputType),
+				w.Parameter("channel", "_protobuf.RpcChannel"),
+				w.EndAbstractFunctionDecl("none"),
+			)
+		default:
+			err = util.FirstError(
+				w.StartAbstractFunctionDecl(method.Name),
+				w.Parameter("request", method.InputType),
+				w.EndAbstractFunctionDecl(method.OutputType),
+			)
+		}
+		if err != nil {
+			return err
+		}
+
+		if method.ClientStreaming() || method.ServerStreaming() {
+			streamingMethods = append(streamingMethods, method)
+		} else {
+			unaryMethods = append(unaryMethods, method)
+		}
+	}
+	if len(methods) > 0 {
+		w.NewLine()
+	}
+
+	if err := g.writeServiceDispatch(w, unaryMethods); err != nil {
+		return err
+	}
+
+	if len(streamingMethods) > 0 {
+		if err := g.writeServiceDispatchStream(w, streamingMethods); err != nil {
+			return err
+		}
+	}
+
+	return w.EndClass()
+}
+
+func (g *generator) writeServiceDispatch(w *toit.Writer, methods []*methodType) error {
+	if err := util.FirstError(
+		w.StartFunctionDecl("dispatch"),
+		w.Parameter("method", "string"),
+		w.Parameter("request", "ByteArray"),
+		w.EndFunctionDecl("ByteArray"),
+	); err != nil {
+		return err
+	}
+
+	if len(methods) == 0 {
+		return util.FirstError(
+			writeThrowUnimplemented(w),
+			w.EndFunction(),
+		)
+	}
+
+	if err := util.FirstError(
+		w.Variable("r", "", "_protobuf.Reader request"),
+		w.Variable("w", "", "_protobuf.Writer"),
+	); err != nil {
+		return err
+	}
+
+	for i, method := range methods {
+		if err := util.FirstError(
+			w.StartCall(ifElse(i)),
+			w.Argument("method == "+method.Constant),
+			w.StartBlock(false),
+			w.Variable("response", "", method.Name+" ("+method.InputType+".deserialize r)"),
+			w.StartCall("response.serialize"),
+			w.Argument("w"),
+			w.EndCall(true),
+			w.EndBlock(false),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		w.StartCall("else"),
+		w.StartBlock(false),
+		writeThrowUnimplemented(w),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.ReturnStart(),
+		w.Argument("w.to_byte_array"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+	)
+}
+
+func (g *generator) writeServiceDispatchStream(w *toit.Writer, methods []*methodType) error {
+	if err := util.FirstError(
+		w.StartFunctionDecl("dispatch_stream"),
+		w.Parameter("method", "string"),
+		w.Parameter("stream", "_protobuf.RpcStream"),
+		w.EndFunctionDecl("none"),
+	); err != nil {
+		return err
+	}
+
+	for i, method := range methods {
+		if err := util.FirstError(
+			w.StartCall(ifElse(i)),
+			w.Argument("method == "+method.Constant),
+			w.StartBlock(false),
+			w.Variable("channel", "", method.handlerChannel()),
+		); err != nil {
+			return err
+		}
+
+		var err error
+		switch {
+		case method.ClientStreaming() && method.ServerStreaming():
+			err = util.FirstError(
+				w.StartCall(method.Name),
+				w.Argument("channel"),
+				w.EndCall(true),
+			)
+		case method.ClientStreaming():
+			err = util.FirstError(
+				w.StartCall("channel.send"),
+				w.Argument("("+method.Name+" channel)"),
+				w.EndCall(true),
+			)
+		default:
+			err = util.FirstError(
+				w.StartCall(method.Name),
+				w.Argument("(channel.receive)"),
+				w.Argument("channel"),
+				w.EndCall(true),
+			)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := util.FirstError(
+			w.StartCall("channel.close_send"),
+			w.EndCall(true),
+			w.EndBlock(false),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		w.StartCall("else"),
+		w.StartBlock(false),
+		writeThrowUnimplemented(w),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.EndFunction(),
+	)
+}
+
+func writeThrowUnimplemented(w *toit.Writer) error {
+	return util.FirstError(
+		w.StartCall("throw"),
+		w.Argument(`"UNIMPLEMENTED"`),
+		w.EndCall(true),
+	)
+}
+
+func ifElse(i int) string {
+	if i == 0 {
+		return "if"
+	}
+	return "else if"
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	plugin "github.com/gogo/protobuf/protoc-gen-gogo/plugin"
+)
+
+func TestServiceNameClash(t *testing.T) {
+	tests := []struct {
+		messages []string
+		enum     string
+		values   []string
+		wantErr  string
+	}{
+		{[]string{"Request"}, "", nil, ""},
+		{[]string{"Request", "GreeterClient"}, "", nil, "name clash for service class: GreeterClient"},
+		{[]string{"Request", "GreeterHandler"}, "", nil, "name clash for service class: GreeterHandler"},
+		{[]string{"Request"}, "Greeter", []string{"SAY"}, "name clash for method constant: Greeter_SAY"},
+	}
+	for _, test := range tests {
+		file := &descriptor.FileDescriptorProto{
+			Name: proto.String("greeter.proto"),
+			Service: []*descriptor.ServiceDescriptorProto{{
+				Name: proto.String("Greeter"),
+				Method: []*descriptor.MethodDescriptorProto{{
+					Name:       proto.String("Say"),
+					InputType:  proto.String(".Request"),
+					OutputType: proto.String(".Request"),
+				}},
+			}},
+		}
+		for _, name := range test.messages {
+			file.MessageType = append(file.MessageType, &descriptor.DescriptorProto{Name: proto.String(name)})
+		}
+		if test.enum != "" {
+			enum := &descriptor.EnumDescriptorProto{Name: proto.String(test.enum)}
+			for i, value := range test.values {
+				enum.Value = append(enum.Value, &descriptor.EnumValueDescriptorProto{Name: proto.String(value), Number: proto.Int32(int32(i))})
+			}
+			file.EnumType = append(file.EnumType, enum)
+		}
+
+		g := &generator{
+			req:     &plugin.CodeGeneratorRequest{ProtoFile: []*descriptor.FileDescriptorProto{file}},
+			options: generatorOptions{Services: true},
+			types:   map[string]*referType{},
+			imports: map[string]string{},
+		}
+		g.resolveTypes()
+		_, err := g.generateFile(file)
+		have := ""
+		if err != nil {
+			have = err.Error()
+		}
+		if have != test.wantErr {
+			t.Errorf("messages=%v enum=%q values=%v: have error %q, want %q", test.messages, test.enum, test.values, have, test.wantErr)
+		}
+	}
+}
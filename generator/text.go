@@ -0,0 +1,352 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+// textHelperNames are the members every message gets for printing the
+// protobuf text format.
+var textHelperNames = []string{"write_text", "to_text", "stringify"}
+
+// parseTextHelperNames are the members every message gets for parsing the
+// protobuf text format.
+var parseTextHelperNames = []string{"parse_text", "read_text"}
+
+// textName returns the name of a field in the text format. Groups use the
+// name of their message type.
+func textName(fieldType *fieldType) string {
+	if fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_GROUP && fieldType.t != nil && fieldType.t.msg != nil {
+		return fieldType.t.msg.GetName()
+	}
+	return fieldType.field.GetName()
+}
+
+func (g *generator) writeTextMethods(w *toit.Writer, fields []*fieldType, oneofTypes []*oneofType) error {
+	if !g.options.TextFormat {
+		return nil
+	}
+	fieldNames := util.NewStringSet()
+	for _, fieldType := range fields {
+		fieldNames.Add(fieldType.FieldName(oneofTypes))
+	}
+	printer := uniqueName("printer", fieldNames, "_")
+
+	return util.FirstError(
+		g.writeWriteTextMethod(w, fields, oneofTypes),
+
+		w.StartFunctionDecl("to_text"),
+		w.ParameterWithDefault("--compact", "bool", "false"),
+		w.EndFunctionDecl("string"),
+		w.Variable(printer, "", "_protobuf.TextPrinter --compact=compact"),
+		w.StartCall("write_text"),
+		w.Argument(printer),
+		w.EndCall(true),
+		w.ReturnStart(),
+		w.Argument(printer+".to_string"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+
+		w.StartFunctionDecl("stringify"),
+		w.EndFunctionDecl("string"),
+		w.ReturnStart(),
+		w.Argument("to_text"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+	)
+}
+
+// writeWriteTextMethod writes a method that renders the fields of the message
+// to a text printer. The fields that are written are the same as the ones
+// written by serialize.
+func (g *generator) writeWriteTextMethod(w *toit.Writer, fields []*fieldType, oneofTypes []*oneofType) error {
+	if err := util.FirstError(
+		w.StartFunctionDecl("write_text"),
+		w.Parameter("printer", "_protobuf.TextPrinter"),
+		w.EndFunctionDecl("none"),
+	); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		if err := util.FirstError(
+			w.Literal("return"),
+			w.EndLine(),
+		); err != nil {
+			return err
+		}
+	}
+
+	for _, fieldType := range fields {
+		fieldName := fieldType.FieldName(oneofTypes)
+		value := "this." + g.getSerializeFieldName(fieldName, nil, nil)
+		name := textName(fieldType)
+
+		switch fieldType.class {
+		case fieldTypeClassList:
+			if err := util.FirstError(
+				w.StartCall(value+".do"),
+				w.StartBlock(false, "element"),
+				g.writeTextValue(w, fieldType.valueType, name, "element"),
+				w.EndBlock(false),
+				w.EndCall(true),
+			); err != nil {
+				return err
+			}
+		case fieldTypeClassMap:
+			if err := util.FirstError(
+				w.StartCall(value+".do"),
+				w.StartBlock(false, "key", "value"),
+				w.StartCall("printer.write_message"),
+				w.Argument(`"`+name+`"`),
+				w.StartBlock(false),
+				g.writeTextValue(w, fieldType.keyType, "key", "key"),
+				g.writeTextValue(w, fieldType.valueType, "value", "value"),
+				w.EndBlock(false),
+				w.EndCall(true),
+				w.EndBlock(false),
+				w.EndCall(true),
+			); err != nil {
+				return err
+			}
+		default:
+			condition, err := g.isSetCondition(fieldType, oneofTypes, "this.")
+			if err != nil {
+				return err
+			}
+			if err := util.FirstError(
+				w.StartCall("if"),
+				w.Argument(condition),
+				w.StartBlock(false),
+				g.writeTextValue(w, fieldType, name, value),
+				w.EndBlock(false),
+				w.EndCall(true),
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return w.EndFunction()
+}
+
+// writeTextValue writes a single value of the given field type to the printer.
+func (g *generator) writeTextValue(w *toit.Writer, fieldType *fieldType, name string, value string) error {
+	name = `"` + name + `"`
+	switch fieldType.class {
+	case fieldTypeClassObject:
+		if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+			return util.FirstError(
+				w.StartCall("printer."+coreObject.WriteText),
+				w.Argument(name),
+				writeArguments(w, coreObject.Arguments),
+				w.Argument(value),
+				w.EndCall(true),
+			)
+		}
+		return util.FirstError(
+			w.StartCall("printer.write_message"),
+			w.Argument(name),
+			w.StartBlock(false),
+			w.StartCall(value+".write_text"),
+			w.Argument("printer"),
+			w.EndCall(true),
+			w.EndBlock(false),
+			w.EndCall(true),
+		)
+	case fieldTypeClassPrimitive:
+		if fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_ENUM {
+			names, err := g.enumTable(fieldType.t, "NAMES")
+			if err != nil {
+				return err
+			}
+			return util.FirstError(
+				w.StartCall("printer.write_enum"),
+				w.Argument(name),
+				w.Argument(value),
+				w.Argument(names),
+				w.EndCall(true),
+			)
+		}
+		protoType, err := protobufTypeConst(fieldType.field.GetType())
+		if err != nil {
+			return err
+		}
+		return util.FirstError(
+			w.StartCall("printer.write_primitive"),
+			w.Argument(name),
+			w.Argument("_protobuf."+protoType),
+			w.Argument(value),
+			w.EndCall(true),
+		)
+	default:
+		return fmt.Errorf("unkonwn fieldType: %v for field: %s", fieldType.class, fieldType.field.GetName())
+	}
+}
+
+// writeParseTextMethods writes the methods that parse the text format. Only
+// parse_text checks the required fields, as read_text is also used for
+// nested messages.
+func (g *generator) writeParseTextMethods(w *toit.Writer, className string, checkRequired bool, fields []*fieldType, oneofTypes []*oneofType) error {
+	if !g.options.TextFormat {
+		return nil
+	}
+	return util.FirstError(
+		w.StartStaticFunctionDecl("parse_text"),
+		w.Parameter("text", "string"),
+		writeCheckInitializedParameter(w, checkRequired),
+		w.EndFunctionDecl(className),
+		w.Variable("parser", "", "_protobuf.TextParser text"),
+		w.Variable("result", "", className+".read_text parser"),
+		w.Literal("parser.expect_end"),
+		w.EndLine(),
+		writeCheckInitialized(w, checkRequired, "result"),
+		w.ReturnStart(),
+		w.Argument("result"),
+		w.ReturnEnd(),
+		w.EndFunction(),
+
+		g.writeReadTextConstructor(w, fields, oneofTypes),
+	)
+}
+
+// writeReadTextConstructor writes a constructor that reads the fields of the
+// message from a text parser. Repeated fields and map entries may occur
+// several times and are added to the existing values.
+func (g *generator) writeReadTextConstructor(w *toit.Writer, fields []*fieldType, oneofTypes []*oneofType) error {
+	if err := util.FirstError(
+		w.StartConstructorDecl("read_text"),
+		w.Parameter("parser", "_protobuf.TextParser"),
+		w.EndConstructorDecl(),
+		w.StartCall("parser.read_fields"),
+		w.StartBlock(false, "name/string"),
+	); err != nil {
+		return err
+	}
+
+	for i, fieldType := range fields {
+		if err := util.FirstError(
+			w.StartCall(ifElse(i)),
+			w.Argument(`name == "`+textName(fieldType)+`"`),
+			w.StartBlock(false),
+			g.writeReadTextField(w, fieldType, oneofTypes),
+			w.EndBlock(false),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+
+	if len(fields) > 0 {
+		if err := util.FirstError(
+			w.StartCall("else"),
+			w.StartBlock(false),
+		); err != nil {
+			return err
+		}
+	}
+	if err := util.FirstError(
+		w.StartCall("parser.unknown_field"),
+		w.Argument("name"),
+		w.EndCall(true),
+	); err != nil {
+		return err
+	}
+	if len(fields) > 0 {
+		if err := util.FirstError(
+			w.EndBlock(false),
+			w.EndCall(true),
+		); err != nil {
+			return err
+		}
+	}
+
+	return util.FirstError(
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.EndConstructor(),
+	)
+}
+
+func (g *generator) writeReadTextField(w *toit.Writer, fieldType *fieldType, oneofTypes []*oneofType) error {
+	fieldName := "this." + fieldType.FieldName(oneofTypes)
+	switch fieldType.class {
+	case fieldTypeClassList:
+		value, err := g.readTextExpression(fieldType.valueType)
+		if err != nil {
+			return err
+		}
+		return util.FirstError(
+			w.StartCall("parser.read_repeated"),
+			w.StartBlock(false),
+			w.StartCall(fieldName+".add"),
+			w.Argument("("+value+")"),
+			w.EndCall(true),
+			w.EndBlock(false),
+			w.EndCall(true),
+		)
+	case fieldTypeClassMap:
+		key, err := g.readTextExpression(fieldType.keyType)
+		if err != nil {
+			return err
+		}
+		value, err := g.readTextExpression(fieldType.valueType)
+		if err != nil {
+			return err
+		}
+		return util.FirstError(
+			w.StartCall("parser.read_repeated"),
+			w.StartBlock(false),
+			w.StartCall("parser.read_map_entry"),
+			w.Argument(fieldName),
+			w.NamedArgument("--key", "(: "+key+")"),
+			w.NamedArgument("--value", "(: "+value+")"),
+			w.EndCall(true),
+			w.EndBlock(false),
+			w.EndCall(true),
+		)
+	default:
+		value, err := g.readTextExpression(fieldType)
+		if err != nil {
+			return err
+		}
+		return g.writeFieldAssignment(w, fieldType, oneofTypes, value)
+	}
+}
+
+// readTextExpression reads a single value of the given field type from the
+// parser.
+func (g *generator) readTextExpression(fieldType *fieldType) (string, error) {
+	switch fieldType.class {
+	case fieldTypeClassObject:
+		if coreObject, ok := g.coreObjectType(fieldType.t); ok {
+			return strings.Join(append([]string{"parser." + coreObject.ReadText}, coreObject.Arguments...), " "), nil
+		}
+		importAlias, ok := g.imports[fieldType.t.file.GetName()]
+		if !ok {
+			return "", fmt.Errorf("failed to find import alias for field: '%s' - field: '%s'", fieldType.t.file.GetName(), fieldType.t.Name())
+		}
+		return "parser.read_message: " + fieldType.t.ToitType(importAlias) + ".read_text parser", nil
+	case fieldTypeClassPrimitive:
+		if fieldType.field.GetType() == descriptor.FieldDescriptorProto_TYPE_ENUM {
+			numbers, err := g.enumTable(fieldType.t, "NUMBERS")
+			if err != nil {
+				return "", err
+			}
+			return "parser.read_enum " + numbers, nil
+		}
+		protoType, err := protobufTypeConst(fieldType.field.GetType())
+		if err != nil {
+			return "", err
+		}
+		return "parser.read_primitive _protobuf." + protoType, nil
+	default:
+		return "", fmt.Errorf("unkonwn fieldType: %v for field: %s", fieldType.class, fieldType.field.GetName())
+	}
+}
@@ -83,10 +83,18 @@ type fieldType struct {
 	t         *referType
 	valueType *fieldType
 	keyType   *fieldType
+	presence  *presenceType
+	// lazy is set for message fields that are only allocated on first access.
+	lazy bool
+}
+
+// IsOneof returns true if the field is part of a oneof that is not synthetic.
+func (f *fieldType) IsOneof() bool {
+	return f.field.OneofIndex != nil && !isProto3Optional(f.field)
 }
 
 func (f *fieldType) FieldName(oneofTypes []*oneofType) string {
-	if f.field.OneofIndex == nil {
+	if !f.IsOneof() {
 		return uniqueName(f.field.GetName(), reservedFieldNames, "_")
 	}
 	oneof := oneofTypes[f.field.GetOneofIndex()]
@@ -97,39 +105,22 @@ func (f *fieldType) DefaultValue() (string, error) {
 	switch f.class {
 	case fieldTypeClassPrimitive:
 		switch f.field.GetType() {
-		case descriptor.FieldDescriptorProto_TYPE_DOUBLE, descriptor.FieldDescriptorProto_TYPE_FLOAT:
-			return "0.0", nil
-		case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_UINT64,
-			descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_UINT32,
-			descriptor.FieldDescriptorProto_TYPE_FIXED64, descriptor.FieldDescriptorProto_TYPE_FIXED32,
-			descriptor.FieldDescriptorProto_TYPE_SFIXED64, descriptor.FieldDescriptorProto_TYPE_SFIXED32,
-			descriptor.FieldDescriptorProto_TYPE_SINT64, descriptor.FieldDescriptorProto_TYPE_SINT32:
-			return "0", nil
-		case descriptor.FieldDescriptorProto_TYPE_BOOL:
-			return "false", nil
-		case descriptor.FieldDescriptorProto_TYPE_STRING:
-			return `""`, nil
-		case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		case descriptor.FieldDescriptorProto_TYPE_MESSAGE, descriptor.FieldDescriptorProto_TYPE_GROUP:
 			importAlias, ok := f.g.imports[f.t.file.GetName()]
 			if !ok {
 				return "", fmt.Errorf("failed to find import alias for file: '%s' - object: '%s'", f.t.file.GetName(), f.t.Name())
 			}
 			return f.t.ToitType(importAlias), nil
-		case descriptor.FieldDescriptorProto_TYPE_BYTES:
-			return "ByteArray 0", nil
 		case descriptor.FieldDescriptorProto_TYPE_ENUM:
-			return "0", nil
-		default:
-			return "", fmt.Errorf("failed to find default value for object: %s, primitve: %s", f.field.GetName(), f.field.GetType())
+			return enumDefaultValue(f.field, f.t)
 		}
+		if f.field.DefaultValue != nil {
+			return defaultValueLiteral(f.field.GetType(), f.field.GetDefaultValue())
+		}
+		return zeroValue(f.field.GetType(), f.field.GetName())
 	case fieldTypeClassObject:
-		if f.g.options.CoreObjects {
-			if f.t.Name() == coreDurationMessage {
-				return "_core.Duration.ZERO", nil
-			}
-			if f.t.Name() == coreTimestampMessage {
-				return "_protobuf.TIME_ZERO_EPOCH", nil
-			}
+		if coreObject, ok := f.g.coreObjectType(f.t); ok {
+			return coreObject.DefaultValue, nil
 		}
 
 		importAlias, ok := f.g.imports[f.t.file.GetName()]
@@ -145,6 +136,66 @@ func (f *fieldType) DefaultValue() (string, error) {
 	return "", fmt.Errorf("failed to find default value for object: %s", f.field.GetName())
 }
 
+// HasCustomDefault returns true if the default value of a primitive field
+// differs from the zero value of its type.
+func (f *fieldType) HasCustomDefault() (bool, error) {
+	if f.class != fieldTypeClassPrimitive || isMessageType(f.field.GetType()) {
+		return false, nil
+	}
+	defaultValue, err := f.DefaultValue()
+	if err != nil {
+		return false, err
+	}
+	zero, err := zeroValue(f.field.GetType(), f.field.GetName())
+	if err != nil {
+		return false, err
+	}
+	return defaultValue != zero, nil
+}
+
+func zeroValue(ft descriptor.FieldDescriptorProto_Type, fieldName string) (string, error) {
+	switch ft {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE, descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return "0.0", nil
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_UINT64,
+		descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_UINT32,
+		descriptor.FieldDescriptorProto_TYPE_FIXED64, descriptor.FieldDescriptorProto_TYPE_FIXED32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64, descriptor.FieldDescriptorProto_TYPE_SFIXED32,
+		descriptor.FieldDescriptorProto_TYPE_SINT64, descriptor.FieldDescriptorProto_TYPE_SINT32:
+		return "0", nil
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return "false", nil
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		return `""`, nil
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		return "ByteArray 0", nil
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		return "0", nil
+	default:
+		return "", fmt.Errorf("failed to find default value for object: %s, primitve: %s", fieldName, ft)
+	}
+}
+
+// isCoreObject returns true if a message field is mapped to a Toit core type.
+func (g *generator) isCoreObject(f *fieldType) bool {
+	if f.t == nil {
+		return false
+	}
+	return g.isCoreMessage(f.t.Name())
+}
+
+func (g *generator) isCoreMessage(name string) bool {
+	_, ok := g.coreMessageType(name)
+	return ok
+}
+
+// isNullableCoreObject returns true if a message field is mapped to a Toit
+// type where null means the field is unset.
+func (g *generator) isNullableCoreObject(f *fieldType) bool {
+	coreObject, ok := g.coreObjectType(f.t)
+	return ok && coreObject.Nullable
+}
+
 func (f *fieldType) ToitTypeAnnotation(optional bool) (string, error) {
 	return f.toitTypeAnnotation(optional, false)
 }
@@ -181,7 +232,7 @@ func (f *fieldType) toitTypeAnnotation(optional, inComment bool) (string, error)
 }
 
 func optionalType(typ string, optional bool) string {
-	if optional {
+	if optional && typ != "any" {
 		return typ + "?"
 	}
 	return typ
@@ -209,14 +260,9 @@ func FieldTypeToToitType(ft descriptor.FieldDescriptorProto_Type, optional, inCo
 		return optionalType("bool", optional), nil
 	case descriptor.FieldDescriptorProto_TYPE_STRING:
 		return optionalType("string", optional), nil
-	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
-		if g.options.CoreObjects {
-			if t.Name() == coreDurationMessage {
-				return optionalType("_core.Duration", optional), nil
-			}
-			if t.Name() == coreTimestampMessage {
-				return optionalType("_core.Time", optional), nil
-			}
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE, descriptor.FieldDescriptorProto_TYPE_GROUP:
+		if coreObject, ok := g.coreObjectType(t); ok {
+			return optionalType(coreObject.Type, optional || coreObject.Nullable), nil
 		}
 		importAlias, ok := g.imports[t.file.GetName()]
 		if !ok {
@@ -249,6 +295,12 @@ func FieldTypeToToitType(ft descriptor.FieldDescriptorProto_Type, optional, inCo
 	}
 }
 
+// isMessageType returns true for the field types that hold a message. Groups
+// are messages that are delimited by tags on the wire.
+func isMessageType(ft descriptor.FieldDescriptorProto_Type) bool {
+	return ft == descriptor.FieldDescriptorProto_TYPE_MESSAGE || ft == descriptor.FieldDescriptorProto_TYPE_GROUP
+}
+
 func protobufTypeConst(ft descriptor.FieldDescriptorProto_Type) (string, error) {
 	switch ft {
 	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
@@ -281,6 +333,8 @@ func protobufTypeConst(ft descriptor.FieldDescriptorProto_Type) (string, error)
 		return "PROTOBUF_TYPE_STRING", nil
 	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
 		return "PROTOBUF_TYPE_MESSAGE", nil
+	case descriptor.FieldDescriptorProto_TYPE_GROUP:
+		return "PROTOBUF_TYPE_GROUP", nil
 	case descriptor.FieldDescriptorProto_TYPE_ENUM:
 		return "PROTOBUF_TYPE_ENUM", nil
 	case descriptor.FieldDescriptorProto_TYPE_BYTES:
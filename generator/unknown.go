@@ -0,0 +1,96 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package generator
+
+import (
+	"github.com/toitware/protoc-gen-toit/toit"
+	"github.com/toitware/protoc-gen-toit/util"
+)
+
+// unknownFieldsName is the member holding the raw tag/value bytes of the
+// fields that were read but are not part of the message definition.
+const unknownFieldsName = "unknown_fields_"
+
+func (g *generator) writeUnknownFieldsVariable(w *toit.Writer) error {
+	if !g.options.UnknownFields {
+		return nil
+	}
+	return w.Variable(unknownFieldsName, "List?/*<ByteArray>*/", "null")
+}
+
+func (g *generator) writeReadUnknownFieldCall(w *toit.Writer, objectName string) error {
+	if !g.options.UnknownFields {
+		return nil
+	}
+	unknownFields := unknownFieldsName
+	if objectName != "" {
+		unknownFields = objectName + "." + unknownFields
+	}
+	return util.FirstError(
+		w.StartCall("r.read_unknown_field"),
+		w.StartBlock(false, "field/ByteArray"),
+		w.StartCall("if"),
+		w.Argument("not "+unknownFields),
+		w.StartBlock(false),
+		w.StartAssignment(unknownFields),
+		w.Argument("[]"),
+		w.EndAssignment(),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.StartCall(unknownFields+".add"),
+		w.Argument("field"),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
+
+func (g *generator) writeSerializeUnknownFields(w *toit.Writer) error {
+	if !g.options.UnknownFields {
+		return nil
+	}
+	return util.FirstError(
+		w.StartCall("if"),
+		w.Argument(unknownFieldsName),
+		w.StartBlock(false),
+		w.StartCall("w.write_unknown_fields"),
+		w.Argument(unknownFieldsName),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
+
+func (g *generator) writeNumUnknownFields(w *toit.Writer) error {
+	return w.ConditionExpression(unknownFieldsName+" == null", "0", unknownFieldsName+".size")
+}
+
+func (g *generator) writeProtobufSizeUnknownFields(w *toit.Writer) error {
+	return w.ConditionExpression(unknownFieldsName+" == null", "0", "(_protobuf.size_unknown_fields "+unknownFieldsName+")")
+}
+
+func (g *generator) writeMergeUnknownFields(w *toit.Writer) error {
+	if !g.options.UnknownFields {
+		return nil
+	}
+	return util.FirstError(
+		w.StartCall("if"),
+		w.Argument("other."+unknownFieldsName),
+		w.StartBlock(false),
+		w.StartCall("if"),
+		w.Argument("not "+unknownFieldsName),
+		w.StartBlock(false),
+		w.StartAssignment(unknownFieldsName),
+		w.Argument("[]"),
+		w.EndAssignment(),
+		w.EndBlock(false),
+		w.EndCall(true),
+		w.StartCall(unknownFieldsName+".add_all"),
+		w.Argument("other."+unknownFieldsName),
+		w.EndCall(true),
+		w.EndBlock(false),
+		w.EndCall(true),
+	)
+}
@@ -7,6 +7,7 @@ package toit
 import (
 	"bytes"
 	"io"
+	"strings"
 
 	"github.com/toitware/protoc-gen-toit/util"
 )
@@ -64,6 +65,27 @@ func (w *Writer) MultiLineComment(s string) error {
 	)
 }
 
+// Toitdoc writes s as a Toitdoc comment at the current indentation. Any "*/"
+// in s is escaped so it doesn't end the comment early.
+func (w *Writer) Toitdoc(s string) error {
+	res := []error{
+		w.write("/**"),
+		w.EndLine(),
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(s, "*/", `*\/`), "\n") {
+		if line == "" {
+			res = append(res, w.NewLine())
+			continue
+		}
+		res = append(res, w.write(line), w.EndLine())
+	}
+	res = append(res,
+		w.write("*/"),
+		w.EndLine(),
+	)
+	return util.FirstError(res...)
+}
+
 func (w *Writer) StaticConst(name string, typ string, value string) error {
 	return util.FirstError(
 		w.write("static "),
@@ -91,6 +113,14 @@ func (w *Writer) Variable(name string, typ string, value string) error {
 	)
 }
 
+func (w *Writer) Field(name string, typ string) error {
+	return util.FirstError(
+		w.write(name),
+		w.Type(typ),
+		w.EndLine(),
+	)
+}
+
 func (w *Writer) Parameter(name string, typ string) error {
 	return util.FirstError(
 		w.Space(),
@@ -214,10 +244,18 @@ func (w *Writer) decIdent() {
 }
 
 func (w *Writer) StartClass(name string, extends string, implements ...string) error {
+	return w.startClass("class ", name, extends, implements...)
+}
+
+func (w *Writer) StartAbstractClass(name string, extends string, implements ...string) error {
+	return w.startClass("abstract class ", name, extends, implements...)
+}
+
+func (w *Writer) startClass(keyword string, name string, extends string, implements ...string) error {
 	defer w.incIdent()
 	var res []error
 	res = append(res,
-		w.write("class "),
+		w.write(keyword),
 		w.write(name),
 	)
 	if extends != "" {
@@ -274,6 +312,26 @@ func (w *Writer) EndFunctionDecl(returnType string) error {
 	return util.FirstError(append(res, w.write(":"), w.EndLine())...)
 }
 
+func (w *Writer) StartAbstractFunctionDecl(name string) error {
+	defer w.incIdent()
+	defer w.incIdent()
+	return util.FirstError(
+		w.write("abstract "),
+		w.write(name),
+	)
+}
+
+func (w *Writer) EndAbstractFunctionDecl(returnType string) error {
+	defer w.decIdent()
+	defer w.decIdent()
+	var res []error
+	if returnType != "" {
+		res = append(res, w.write(" -> "), w.write(returnType))
+	}
+
+	return util.FirstError(append(res, w.EndLine())...)
+}
+
 func (w *Writer) EndFunction() error {
 	defer w.decIdent()
 	return w.NewLine()
@@ -0,0 +1,33 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package toit
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestToitdoc(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"A single line.", "  /**\n  A single line.\n  */\n"},
+		{"First line.\n\nSecond paragraph.", "  /**\n  First line.\n\n  Second paragraph.\n  */\n"},
+		{"Ends the comment */ early.", "  /**\n  Ends the comment *\\/ early.\n  */\n"},
+	}
+	for _, test := range tests {
+		buffer := bytes.NewBuffer(nil)
+		w := NewWriter(buffer)
+		w.incIdent()
+		if err := w.Toitdoc(test.input); err != nil {
+			t.Fatal(err)
+		}
+		have := buffer.String()
+		if have != test.want {
+			t.Errorf("input=%q:\nhave: %q\nwant: %q", test.input, have, test.want)
+		}
+	}
+}